@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkDelivery measures how fast the server relays lines between
+// plain text clients on a loopback listener. In each iteration every
+// client sends one line, which every client must receive, each
+// sender's lines in the order they were sent.
+//
+// The next iteration starts only once every client has received every
+// line of the previous one, so no queue holds more than one line per
+// sender. The benchmark therefore measures relaying and never fills a
+// queue far enough to disconnect a client as too slow, even with as
+// many clients as a queue has room for lines.
+func BenchmarkDelivery(b *testing.B) {
+	mod, err := newModeration("", "", "", "", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := NewServer(mod)
+	go server.run()
+	go server.serve(listener)
+
+	for _, clients := range []int{10, 100, 500, 1000} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			benchmarkDelivery(b, server, listener.Addr().String(), clients)
+		})
+	}
+}
+
+func benchmarkDelivery(b *testing.B, server *ChatServer, addr string, clients int) {
+	conns := make([]net.Conn, clients)
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatalf("could not connect client %d: %v", i, err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Minute))
+		conns[i] = conn
+	}
+	// Lines sent before everyone has joined would not reach the late
+	// joiners, and clients of an earlier run may still be leaving.
+	for {
+		server.mutex.Lock()
+		joined := len(server.clients)
+		server.mutex.Unlock()
+		if joined == clients {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	want := clients * b.N
+	delivered := make([]int, clients)
+	outOfOrder := make([]int, clients)
+	// Each reader reports here when it has an iteration's every line.
+	rounds := make(chan bool, clients)
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			next := make([]int, clients)
+			scanner := bufio.NewScanner(conn)
+			for delivered[i] < want && scanner.Scan() {
+				_, text, _ := strings.Cut(scanner.Text(), ": ")
+				first, second, _ := strings.Cut(text, " ")
+				sender, err1 := strconv.Atoi(first)
+				seq, err2 := strconv.Atoi(second)
+				if err1 != nil || err2 != nil || sender < 0 || sender >= clients {
+					continue
+				}
+				if seq != next[sender] {
+					outOfOrder[i]++
+				}
+				next[sender] = seq + 1
+				delivered[i]++
+				if delivered[i]%clients == 0 {
+					rounds <- true
+				}
+			}
+			if delivered[i] < want {
+				rounds <- false
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	for seq := range b.N {
+		for i, conn := range conns {
+			fmt.Fprintf(conn, "%d %d\n", i, seq)
+		}
+		complete := true
+		for range clients {
+			complete = <-rounds && complete
+		}
+		if !complete {
+			break
+		}
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	var total, unordered int
+	for i := range clients {
+		total += delivered[i]
+		unordered += outOfOrder[i]
+	}
+	b.ReportMetric(float64(total)/b.Elapsed().Seconds(), "lines/s")
+	if missing := clients*want - total; missing != 0 || unordered != 0 {
+		b.Fatalf("%d lines missing and %d out of order", missing, unordered)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// command is a slash command a client can type. Commands are added to
+// the registry with registerCommand, usually from an init function next
+// to their implementation.
+type command struct {
+	name  string
+	usage string // arguments, shown by /help
+	help  string
+	run   func(server *ChatServer, client *Client, args string)
+}
+
+var commands = make(map[string]*command)
+
+func (cmd *command) synopsis() string {
+	return strings.TrimSpace("/" + cmd.name + " " + cmd.usage)
+}
+
+func registerCommand(name, usage, help string, run func(server *ChatServer, client *Client, args string)) {
+	if _, dup := commands[name]; dup {
+		panic("duplicate command /" + name)
+	}
+	commands[name] = &command{name: name, usage: usage, help: help, run: run}
+}
+
+func init() {
+	registerCommand("help", "[command]", "list commands or describe one", helpCommand)
+	registerCommand("nick", "<name>", "change your nickname", nickCommand)
+	registerCommand("who", "", "list who is online", whoCommand)
+	registerCommand("me", "<action>", "describe an action, as in /me waves", meCommand)
+	registerCommand("msg", "<nick> <text>", "send a private message", msgCommand)
+	registerCommand("quit", "[message]", "leave the chat", quitCommand)
+}
+
+// command runs a line starting with a slash.
+func (server *ChatServer) command(client *Client, line string) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	cmd, ok := commands[strings.ToLower(name)]
+	if !ok {
+		client.send("Unknown command /%s, try /help", name)
+		return
+	}
+	cmd.run(server, client, strings.TrimSpace(args))
+}
+
+func helpCommand(server *ChatServer, client *Client, args string) {
+	if args != "" {
+		cmd, ok := commands[strings.ToLower(strings.TrimPrefix(args, "/"))]
+		if !ok {
+			client.send("Unknown command %s", args)
+			return
+		}
+		client.send("%s - %s", cmd.synopsis(), cmd.help)
+		return
+	}
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	client.send("Commands:")
+	for _, name := range names {
+		cmd := commands[name]
+		client.send("  %-36s %s", cmd.synopsis(), cmd.help)
+	}
+}
+
+var nickPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func nickCommand(server *ChatServer, client *Client, nick string) {
+	if !nickPattern.MatchString(nick) {
+		client.send("Nicknames are 1-32 letters, digits, '_' or '-'")
+		return
+	}
+	if _, banned := server.mod.banned(nick, ""); banned {
+		client.send("The nickname %s is banned", nick)
+		return
+	}
+
+	old, err := server.rename(client, nick)
+	if err != nil {
+		client.send("%s", err)
+		return
+	}
+	if old != nick {
+		server.nickChanged(client, old)
+	}
+}
+
+func whoCommand(server *ChatServer, client *Client, _ string) {
+	server.mutex.Lock()
+	names := make([]string, 0, len(server.clients))
+	for c := range server.clients {
+		switch c.role {
+		case roleAdmin:
+			names = append(names, "@"+c.nickname)
+		case roleModerator:
+			names = append(names, "+"+c.nickname)
+		default:
+			names = append(names, c.nickname)
+		}
+	}
+	server.mutex.Unlock()
+
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(strings.TrimLeft(names[i], "@+")) < strings.ToLower(strings.TrimLeft(names[j], "@+"))
+	})
+	client.send("Online (%d): %s", len(names), strings.Join(names, ", "))
+}
+
+func meCommand(server *ChatServer, client *Client, action string) {
+	if action == "" {
+		client.send("Usage: /me <action>")
+		return
+	}
+	if server.checkMuted(client) {
+		return
+	}
+	server.say(client, defaultChannel, "PRIVMSG", "\x01ACTION "+action+"\x01")
+}
+
+func msgCommand(server *ChatServer, client *Client, args string) {
+	nick, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if nick == "" || text == "" {
+		client.send("Usage: /msg <nick> <text>")
+		return
+	}
+	if server.checkMuted(client) {
+		return
+	}
+	target, name := server.findClient(nick)
+	if target == nil {
+		client.send("No such user: %s", nick)
+		return
+	}
+
+	server.privmsg(client, target, "PRIVMSG", text)
+	if target != client {
+		client.send("[private to %s] %s", name, text)
+	}
+}
+
+func quitCommand(server *ChatServer, client *Client, message string) {
+	server.mutex.Lock()
+	client.quitMessage = message
+	server.mutex.Unlock()
+	client.send("Goodbye!")
+	client.close()
+}
+
+// checkMuted tells client if it is muted and reports whether it is.
+func (server *ChatServer) checkMuted(client *Client) bool {
+	server.mutex.Lock()
+	operator := client.role >= roleModerator
+	server.mutex.Unlock()
+
+	if left := server.mod.mutedFor(client, operator); left > 0 {
+		client.send("You are muted for another %v", left)
+		return true
+	}
+	return false
+}
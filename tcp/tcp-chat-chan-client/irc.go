@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The IRC listener speaks enough of RFC 1459 and RFC 2812 for clients
+// such as irssi or weechat: registration with NICK and USER, channels
+// with JOIN, PART, NAMES and TOPIC, PRIVMSG and NOTICE to channels and
+// nicknames, PING/PONG and QUIT. IRC clients share nicknames, roles,
+// bans and mutes with the plain text protocol, whose users all sit in
+// defaultChannel. KICK and OPER map onto /kick and /oper; slash
+// commands are not available otherwise.
+const ircServerName = "chat"
+
+var (
+	channelPattern = regexp.MustCompile(`^[#&][^\x00\x07\r\n ,:]{1,49}$`)
+	serverStarted  = time.Now()
+)
+
+func isChannel(name string) bool {
+	return strings.HasPrefix(name, "#") || strings.HasPrefix(name, "&")
+}
+
+type ircState struct {
+	user, realname string
+}
+
+// prefix returns nick!user@host as used on IRC. The caller must hold
+// ChatServer.mutex.
+func (c *Client) prefix() string {
+	user := "chat"
+	if c.irc != nil {
+		user = c.irc.user
+	}
+	return fmt.Sprintf("%s!%s@%s", c.nickname, user, c.ip)
+}
+
+func (server *ChatServer) serveIRC(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Error accepting IRC connection:", err)
+			continue
+		}
+
+		client := newClient(conn, &ircState{})
+		if !server.admit(client) {
+			continue
+		}
+		go server.handleIRC(client)
+	}
+}
+
+// ircSession is the connection state of one IRC client.
+type ircSession struct {
+	server     *ChatServer
+	client     *Client
+	nick       string // requested before registration
+	registered bool
+}
+
+func (server *ChatServer) handleIRC(client *Client) {
+	s := &ircSession{server: server, client: client}
+	reader := bufio.NewReader(client.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if s.registered {
+				server.depart(client)
+			}
+			client.close()
+			return
+		}
+
+		command, params := parseIRC(strings.TrimRight(line, "\r\n"))
+		if command != "" {
+			s.handle(command, params)
+		}
+	}
+}
+
+// parseIRC splits a line into its command and parameters, dropping any
+// prefix. The trailing parameter, after " :", may contain spaces.
+func parseIRC(line string) (string, []string) {
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	params := strings.Fields(line)
+	if len(params) == 0 {
+		return "", nil
+	}
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// sendf writes one line to the client.
+func (s *ircSession) sendf(format string, args ...any) {
+	s.client.sendLine(fmt.Sprintf(format, args...))
+}
+
+// reply sends a numeric reply addressed to the client's nickname.
+func (s *ircSession) reply(code, format string, args ...any) {
+	nick := s.nick
+	if s.registered {
+		nick = s.server.nameOf(s.client)
+	}
+	if nick == "" {
+		nick = "*"
+	}
+	s.sendf(":%s %s %s %s", ircServerName, code, nick, fmt.Sprintf(format, args...))
+}
+
+func (s *ircSession) handle(command string, params []string) {
+	switch command {
+	case "CAP":
+		// No capabilities are offered, which clients that negotiate
+		// them take as plain RFC 1459.
+		if len(params) > 0 {
+			switch strings.ToUpper(params[0]) {
+			case "LS", "LIST":
+				s.sendf(":%s CAP * %s :", ircServerName, strings.ToUpper(params[0]))
+			case "REQ":
+				s.sendf(":%s CAP * NAK :%s", ircServerName, strings.Join(params[1:], " "))
+			}
+		}
+	case "PASS", "PONG":
+	case "PING":
+		s.sendf(":%s PONG %s :%s", ircServerName, ircServerName, strings.Join(params, " "))
+	case "NICK":
+		s.nickCommand(params)
+	case "USER":
+		s.userCommand(params)
+	case "QUIT":
+		if len(params) > 0 {
+			s.server.mutex.Lock()
+			s.client.quitMessage = params[0]
+			s.server.mutex.Unlock()
+		}
+		s.sendf("ERROR :Closing link")
+		s.client.close()
+	default:
+		if !s.registered {
+			s.reply("451", ":You have not registered")
+			return
+		}
+		s.handleRegistered(command, params)
+	}
+}
+
+func (s *ircSession) handleRegistered(command string, params []string) {
+	enough := func(n int) bool {
+		if len(params) < n {
+			s.reply("461", "%s :Not enough parameters", command)
+			return false
+		}
+		return true
+	}
+
+	switch command {
+	case "JOIN":
+		if !enough(1) {
+			return
+		}
+		if params[0] == "0" {
+			for _, name := range s.server.channelsOf(s.client) {
+				s.server.part(s.client, name, "")
+			}
+			return
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			s.join(name)
+		}
+	case "PART":
+		if !enough(1) {
+			return
+		}
+		message := ""
+		if len(params) > 1 {
+			message = params[1]
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			if !s.server.part(s.client, name, message) {
+				s.reply("442", "%s :You're not on that channel", name)
+			}
+		}
+	case "PRIVMSG", "NOTICE":
+		s.privmsg(command, params)
+	case "NAMES":
+		if len(params) == 0 {
+			s.reply("366", "* :End of /NAMES list")
+			return
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			s.names(name)
+		}
+	case "TOPIC":
+		if enough(1) {
+			s.topic(params)
+		}
+	case "MODE":
+		if enough(1) {
+			s.mode(params)
+		}
+	case "WHO":
+		if enough(1) {
+			s.who(params[0])
+		}
+	case "OPER":
+		if enough(2) {
+			s.server.operCommand(s.client, params[1])
+		}
+	case "KICK":
+		// There are no per-channel operators, so KICK disconnects the
+		// user just like /kick.
+		if !enough(2) {
+			return
+		}
+		reason := ""
+		if len(params) > 2 {
+			reason = params[2]
+		}
+		s.server.kickCommand(s.client, params[1]+" "+reason)
+	default:
+		s.reply("421", "%s :Unknown command", command)
+	}
+}
+
+func (s *ircSession) nickCommand(params []string) {
+	if len(params) == 0 || params[0] == "" {
+		s.reply("431", ":No nickname given")
+		return
+	}
+	nick := params[0]
+	if !nickPattern.MatchString(nick) {
+		s.reply("432", "%s :Erroneous nickname", nick)
+		return
+	}
+	if _, banned := s.server.mod.banned(nick, ""); banned {
+		s.reply("432", "%s :Nickname is banned", nick)
+		return
+	}
+
+	if !s.registered {
+		s.nick = nick
+		s.register()
+		return
+	}
+	old, err := s.server.rename(s.client, nick)
+	if err != nil {
+		s.reply("433", "%s :Nickname is already in use", nick)
+		return
+	}
+	if old != nick {
+		s.server.nickChanged(s.client, old)
+	}
+}
+
+func (s *ircSession) userCommand(params []string) {
+	if s.registered {
+		s.reply("462", ":You may not reregister")
+		return
+	}
+	if len(params) < 4 {
+		s.reply("461", "USER :Not enough parameters")
+		return
+	}
+	s.client.irc.user = params[0]
+	if !nickPattern.MatchString(s.client.irc.user) {
+		s.client.irc.user = "user"
+	}
+	s.client.irc.realname = params[3]
+	s.register()
+}
+
+// register completes registration once both NICK and USER have been
+// received.
+func (s *ircSession) register() {
+	if s.nick == "" || s.client.irc.user == "" {
+		return
+	}
+	if err := s.server.registerIRC(s.client, s.nick); err != nil {
+		nick := s.nick
+		s.nick = ""
+		s.reply("433", "%s :Nickname is already in use", nick)
+		return
+	}
+	s.registered = true
+
+	s.reply("001", ":Welcome to the chat, %s!%s@%s", s.nick, s.client.irc.user, s.client.ip)
+	s.reply("002", ":Your host is %s", ircServerName)
+	s.reply("003", ":This server was created %s", serverStarted.Format(time.RFC1123))
+	s.reply("004", "%s 1.0 o o", ircServerName)
+	s.reply("005", "CHANTYPES=#& PREFIX=(ov)@+ NICKLEN=32 CHANNELLEN=50 CASEMAPPING=ascii :are supported by this server")
+	s.reply("375", ":- %s Message of the day -", ircServerName)
+	s.reply("372", ":- Users of the plain text protocol are in %s.", defaultChannel)
+	s.reply("376", ":End of /MOTD command")
+}
+
+// registerIRC gives client its nickname and adds it to the server,
+// unless the nickname is in use.
+func (server *ChatServer) registerIRC(client *Client, nick string) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if _, taken := server.nicks[strings.ToLower(nick)]; taken {
+		return fmt.Errorf("The nickname %s is already in use", nick)
+	}
+	client.nickname = nick
+	server.nicks[strings.ToLower(nick)] = client
+	server.clients[client] = true
+	return nil
+}
+
+func (s *ircSession) join(name string) {
+	if !channelPattern.MatchString(name) {
+		s.reply("403", "%s :No such channel", name)
+		return
+	}
+	ch, joined := s.server.join(s.client, name)
+	if !joined {
+		return
+	}
+	if topic := s.server.topicOf(ch.name); topic != "" {
+		s.reply("332", "%s :%s", ch.name, topic)
+	}
+	s.names(ch.name)
+}
+
+func (s *ircSession) privmsg(verb string, params []string) {
+	// Errors are never sent in reply to a NOTICE.
+	fail := func(code, format string, args ...any) {
+		if verb == "PRIVMSG" {
+			s.reply(code, format, args...)
+		}
+	}
+	if len(params) == 0 {
+		fail("411", ":No recipient given (%s)", verb)
+		return
+	}
+	if len(params) < 2 || params[1] == "" {
+		fail("412", ":No text to send")
+		return
+	}
+	if s.server.checkMuted(s.client) {
+		return
+	}
+
+	text := params[1]
+	for _, target := range strings.Split(params[0], ",") {
+		if isChannel(target) {
+			if err := s.server.say(s.client, target, verb, text); err != nil {
+				fail("404", "%s :Cannot send to channel", target)
+			}
+			continue
+		}
+		to, _ := s.server.findClient(target)
+		if to == nil {
+			fail("401", "%s :No such nick/channel", target)
+			continue
+		}
+		s.server.privmsg(s.client, to, verb, text)
+	}
+}
+
+// names sends the member list of the named channel, with @ marking
+// admins and + moderators.
+func (s *ircSession) names(name string) {
+	s.server.mutex.Lock()
+	var nicks []string
+	if ch, ok := s.server.channels[strings.ToLower(name)]; ok {
+		name = ch.name
+		for c := range ch.members {
+			nicks = append(nicks, rolePrefix(c.role)+c.nickname)
+		}
+	}
+	s.server.mutex.Unlock()
+
+	// Keep each reply well below the 512 byte line limit.
+	for len(nicks) > 0 {
+		n := min(len(nicks), 20)
+		s.reply("353", "= %s :%s", name, strings.Join(nicks[:n], " "))
+		nicks = nicks[n:]
+	}
+	s.reply("366", "%s :End of /NAMES list", name)
+}
+
+func rolePrefix(r role) string {
+	switch r {
+	case roleAdmin:
+		return "@"
+	case roleModerator:
+		return "+"
+	default:
+		return ""
+	}
+}
+
+// topic shows or sets the topic. Only defaultChannel has one, and it
+// is the server topic that /topic manages.
+func (s *ircSession) topic(params []string) {
+	name := params[0]
+	if !strings.EqualFold(name, defaultChannel) {
+		if len(params) > 1 {
+			s.reply("482", "%s :Only %s has a topic", name, defaultChannel)
+		} else {
+			s.reply("331", "%s :No topic is set", name)
+		}
+		return
+	}
+
+	if len(params) > 1 {
+		topic := params[1]
+		if topic == "" {
+			topic = "-"
+		}
+		s.server.topicCommand(s.client, topic)
+		return
+	}
+	if topic := s.server.topicOf(defaultChannel); topic != "" {
+		s.reply("332", "%s :%s", defaultChannel, topic)
+	} else {
+		s.reply("331", "%s :No topic is set", defaultChannel)
+	}
+}
+
+func (server *ChatServer) topicOf(name string) string {
+	if !strings.EqualFold(name, defaultChannel) {
+		return ""
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.topic
+}
+
+// mode answers mode queries; channels and users have no modes that can
+// be changed.
+func (s *ircSession) mode(params []string) {
+	target := params[0]
+	if !isChannel(target) {
+		if !strings.EqualFold(target, s.server.nameOf(s.client)) {
+			s.reply("502", ":Cannot change mode for other users")
+		} else if len(params) == 1 {
+			s.reply("221", "+")
+		}
+		return
+	}
+
+	switch {
+	case len(params) == 1:
+		s.reply("324", "%s +", target)
+	case strings.TrimPrefix(params[1], "+") == "b" && len(params) == 2:
+		s.reply("368", "%s :End of channel ban list", target)
+	default:
+		s.reply("482", "%s :Channel modes cannot be changed", target)
+	}
+}
+
+// who lists the members of a channel, or the user with the given
+// nickname.
+func (s *ircSession) who(mask string) {
+	s.server.mutex.Lock()
+	var members []*Client
+	if ch, ok := s.server.channels[strings.ToLower(mask)]; ok {
+		for c := range ch.members {
+			members = append(members, c)
+		}
+	} else if c, ok := s.server.nicks[strings.ToLower(mask)]; ok {
+		members = append(members, c)
+	}
+	var lines []string
+	for _, c := range members {
+		user, realname := c.nickname, c.nickname
+		if c.irc != nil {
+			user, realname = c.irc.user, c.irc.realname
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s %s %s H%s :0 %s",
+			mask, user, c.ip, ircServerName, c.nickname, rolePrefix(c.role), realname))
+	}
+	s.server.mutex.Unlock()
+
+	for _, line := range lines {
+		s.reply("352", "%s", line)
+	}
+	s.reply("315", "%s :End of WHO list", mask)
+}
+
+// channelsOf returns the names of the channels client is in.
+func (server *ChatServer) channelsOf(client *Client) []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	var names []string
+	for _, ch := range server.channels {
+		if ch.members[client] {
+			names = append(names, ch.name)
+		}
+	}
+	return names
+}
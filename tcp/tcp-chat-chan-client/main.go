@@ -2,87 +2,531 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"time"
+)
+
+// A client may fall sendQueueSize lines behind before it is
+// disconnected, and a single write may take up to writeTimeout.
+const (
+	sendQueueSize = 1024
+	writeTimeout  = 10 * time.Second
 )
 
 type Client struct {
 	conn     net.Conn
-	nickname string
+	nickname string // guarded by ChatServer.mutex; set by run on register
+	ip       string
+	role     role // guarded by ChatServer.mutex
+
+	quitMessage string // guarded by ChatServer.mutex; set by /quit before the connection closes
+
+	irc *ircState // nil for clients of the plain text protocol
+
+	// Everything sent to the client goes through out to a single
+	// writer goroutine, so lines arrive in the order they were queued
+	// and nobody waits for a slow connection.
+	out       chan string
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newClient(conn net.Conn, irc *ircState) *Client {
+	c := &Client{
+		conn:    conn,
+		ip:      remoteIP(conn),
+		irc:     irc,
+		out:     make(chan string, sendQueueSize),
+		closing: make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// send writes a line to the client alone. IRC clients receive it as a
+// notice from the server.
+func (c *Client) send(format string, args ...any) {
+	if c.irc != nil {
+		c.sendLine(fmt.Sprintf(":%s NOTICE * :%s", ircServerName, fmt.Sprintf(format, args...)))
+		return
+	}
+	c.sendLine(fmt.Sprintf(format, args...))
+}
+
+// lineBreaks replaces what would let relayed text end a line early or
+// smuggle extra commands into an IRC line.
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ", "\x00", " ")
+
+// sendLine queues line without blocking. A client whose queue is full
+// is disconnected rather than allowed to hold up everyone else.
+func (c *Client) sendLine(line string) {
+	line = lineBreaks.Replace(line)
+	if c.irc != nil {
+		line += "\r\n"
+	} else {
+		line += "\n"
+	}
+
+	select {
+	case <-c.closing:
+		return
+	default:
+	}
+	// Once writeLoop has given up on the connection, the queue fills
+	// without the client being slow.
+	select {
+	case c.out <- line:
+	case <-c.closing:
+	default:
+		log.Printf("Disconnecting %s: too slow to keep up", c.ip)
+		c.close()
+		c.conn.Close()
+	}
+}
+
+// close disconnects the client once the lines queued so far are
+// written.
+func (c *Client) close() {
+	c.closeOnce.Do(func() { close(c.closing) })
+}
+
+func (c *Client) writeLoop() {
+	defer c.conn.Close()
+	defer c.close()
+
+	w := bufio.NewWriter(c.conn)
+	for {
+		select {
+		case line := <-c.out:
+			if !c.write(w, line) {
+				return
+			}
+		case <-c.closing:
+			for {
+				select {
+				case line := <-c.out:
+					if !c.write(w, line) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write buffers line and flushes once the queue is empty, so that a
+// burst goes out in a few large writes.
+func (c *Client) write(w *bufio.Writer, line string) bool {
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := w.WriteString(line); err != nil {
+		return false
+	}
+	if len(c.out) > 0 {
+		return true
+	}
+	return w.Flush() == nil
+}
+
+// Plain text clients are always members of defaultChannel, which IRC
+// clients can join to talk with them.
+const defaultChannel = "#lobby"
+
+type channel struct {
+	name    string
+	members map[*Client]bool
 }
 
 type ChatServer struct {
-	clients    map[*Client]bool
-	broadcast  chan string
-	register   chan *Client
-	unregister chan *Client
-	mutex      sync.Mutex
+	clients   map[*Client]bool
+	nicks     map[string]*Client  // by lowercased nickname
+	channels  map[string]*channel // by lowercased name
+	nextGuest int
+	register  chan *Client
+	mutex     sync.Mutex
+	topic     string // guarded by mutex
+
+	// Announcements and departures wait in events until run takes
+	// them, so posting one never blocks a client's goroutine.
+	events   []event // guarded by eventsMu
+	eventsMu sync.Mutex
+	wake     chan struct{} // signals run that events is not empty
+
+	mod *moderation
 }
 
-func NewServer() *ChatServer {
-	return &ChatServer{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan string),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+func NewServer(mod *moderation) *ChatServer {
+	server := &ChatServer{
+		clients:  make(map[*Client]bool),
+		nicks:    make(map[string]*Client),
+		channels: make(map[string]*channel),
+		register: make(chan *Client),
+		wake:     make(chan struct{}, 1),
+		mod:      mod,
 	}
+	server.channels[defaultChannel] = &channel{name: defaultChannel, members: make(map[*Client]bool)}
+	return server
 }
 
+// run handles registrations, departures and announcements in order.
+// Nothing here waits on a client: lines are queued with sendLine, which
+// never blocks, so one stalled connection cannot hold up the loop.
 func (server *ChatServer) run() {
 	for {
 		select {
+		// A client's reader starts only once its join has been
+		// announced, and it posts its departure after its last message,
+		// so everyone sees the join first and the leave last. IRC
+		// clients register themselves and join channels on request.
 		case client := <-server.register:
 			server.mutex.Lock()
 			server.clients[client] = true
+			server.assignGuestName(client)
 			server.mutex.Unlock()
-			server.broadcast <- fmt.Sprintf("%s joined the chat", client.nickname)
-		case client := <-server.unregister:
-			server.mutex.Lock()
-			if _, ok := server.clients[client]; ok {
-				delete(server.clients, client)
-				close := fmt.Sprintf("%s left the chat", client.nickname)
-				server.broadcast <- close
+			server.join(client, defaultChannel)
+			go server.handleClient(client)
+		case <-server.wake:
+			server.eventsMu.Lock()
+			events := server.events
+			server.events = nil
+			server.eventsMu.Unlock()
+			for _, e := range events {
+				if e.leaving != nil {
+					server.quit(e.leaving)
+					server.mod.forget(e.leaving)
+				} else {
+					server.deliver(e.message)
+				}
 			}
-			server.mutex.Unlock()
-		case message := <-server.broadcast:
-			server.mutex.Lock()
-			for client := range server.clients {
-				go func(c *Client, msg string) {
-					fmt.Fprintf(c.conn, "%s\n", msg)
-				}(client, message)
-			}
-			server.mutex.Unlock()
 		}
 	}
 }
 
+// event is an announcement, or a departure if leaving is set, waiting
+// for run.
+type event struct {
+	message string
+	leaving *Client
+}
+
+// announce hands message to run to send to every client.
+func (server *ChatServer) announce(message string) {
+	server.post(event{message: message})
+}
+
+// depart hands client's departure to run, after anything it announced.
+func (server *ChatServer) depart(client *Client) {
+	server.post(event{leaving: client})
+}
+
+// post queues e for run without waiting for it.
+func (server *ChatServer) post(e event) {
+	server.eventsMu.Lock()
+	server.events = append(server.events, e)
+	server.eventsMu.Unlock()
+	select {
+	case server.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends an announcement to every client.
+func (server *ChatServer) deliver(message string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for client := range server.clients {
+		client.send("%s", message)
+	}
+}
+
+// notify sends line to the plain text clients and ircLine to the IRC
+// clients among recipients, skipping empty ones. The caller must hold
+// mutex.
+func (server *ChatServer) notify(recipients map[*Client]bool, line, ircLine string) {
+	for client := range recipients {
+		if client.irc == nil && line != "" {
+			client.sendLine(line)
+		} else if client.irc != nil && ircLine != "" {
+			client.sendLine(ircLine)
+		}
+	}
+}
+
+// join adds client to the named channel, creating it if needed, and
+// tells the members, including client. It returns the channel and
+// false if client was already a member.
+func (server *ChatServer) join(client *Client, name string) (*channel, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	ch, ok := server.channels[strings.ToLower(name)]
+	if !ok {
+		ch = &channel{name: name, members: make(map[*Client]bool)}
+		server.channels[strings.ToLower(name)] = ch
+	}
+	if ch.members[client] {
+		return ch, false
+	}
+	ch.members[client] = true
+	server.notify(ch.members,
+		fmt.Sprintf("%s joined the chat", client.nickname),
+		fmt.Sprintf(":%s JOIN %s", client.prefix(), ch.name))
+	return ch, true
+}
+
+// part removes client from the named channel and tells the members,
+// including client. It reports whether client was a member.
+func (server *ChatServer) part(client *Client, name, message string) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	ch, ok := server.channels[strings.ToLower(name)]
+	if !ok || !ch.members[client] {
+		return false
+	}
+	server.notify(ch.members,
+		leaveLine(client.nickname, message),
+		fmt.Sprintf(":%s PART %s :%s", client.prefix(), ch.name, message))
+	server.leave(client, ch)
+	return true
+}
+
+// quit forgets client and tells everyone sharing a channel with it.
+func (server *ChatServer) quit(client *Client) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if !server.clients[client] {
+		return
+	}
+	delete(server.clients, client)
+	delete(server.nicks, strings.ToLower(client.nickname))
+
+	peers := make(map[*Client]bool)
+	for _, ch := range server.channels {
+		if ch.members[client] {
+			maps.Copy(peers, ch.members)
+			server.leave(client, ch)
+		}
+	}
+	delete(peers, client)
+	server.notify(peers,
+		leaveLine(client.nickname, client.quitMessage),
+		fmt.Sprintf(":%s QUIT :%s", client.prefix(), client.quitMessage))
+}
+
+// leave removes client from ch, dropping ch once it is empty. The
+// caller must hold mutex.
+func (server *ChatServer) leave(client *Client, ch *channel) {
+	delete(ch.members, client)
+	if len(ch.members) == 0 && ch.name != defaultChannel {
+		delete(server.channels, strings.ToLower(ch.name))
+	}
+}
+
+func leaveLine(nick, message string) string {
+	if message == "" {
+		return fmt.Sprintf("%s left the chat", nick)
+	}
+	return fmt.Sprintf("%s left the chat (%s)", nick, message)
+}
+
+// say sends text from client to the members of the named channel as a
+// PRIVMSG or NOTICE. Plain text clients see their own messages too.
+func (server *ChatServer) say(client *Client, name, verb, text string) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	ch, ok := server.channels[strings.ToLower(name)]
+	if !ok || !ch.members[client] {
+		return fmt.Errorf("You are not in %s", name)
+	}
+	line := chatLine(client.nickname, text)
+	ircLine := fmt.Sprintf(":%s %s %s :%s", client.prefix(), verb, ch.name, text)
+	for c := range ch.members {
+		if c.irc == nil && line != "" {
+			c.sendLine(line)
+		} else if c.irc != nil && c != client {
+			c.sendLine(ircLine)
+		}
+	}
+	return nil
+}
+
+// privmsg sends text from client to target alone.
+func (server *ChatServer) privmsg(client, target *Client, verb, text string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	line := fmt.Sprintf("[private from %s] %s", client.nickname, text)
+	if strings.HasPrefix(text, "\x01") {
+		if line = chatLine(client.nickname, text); line != "" {
+			line = "[private] " + line
+		}
+	}
+	server.notify(map[*Client]bool{target: true},
+		line,
+		fmt.Sprintf(":%s %s %s :%s", client.prefix(), verb, target.nickname, text))
+}
+
+// chatLine renders a message for plain text clients. Actions use CTCP
+// ACTION as on IRC; other CTCP requests are not shown.
+func chatLine(nick, text string) string {
+	if ctcp, ok := strings.CutPrefix(text, "\x01"); ok {
+		action, ok := strings.CutPrefix(strings.TrimSuffix(ctcp, "\x01"), "ACTION ")
+		if !ok {
+			return ""
+		}
+		return fmt.Sprintf("* %s %s", nick, action)
+	}
+	return fmt.Sprintf("%s: %s", nick, text)
+}
+
+// nickChanged tells client and everyone sharing a channel with it that
+// it is now known by its current nickname rather than old.
+func (server *ChatServer) nickChanged(client *Client, old string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	peers := map[*Client]bool{client: true}
+	for _, ch := range server.channels {
+		if ch.members[client] {
+			maps.Copy(peers, ch.members)
+		}
+	}
+	prefix := old + strings.TrimPrefix(client.prefix(), client.nickname)
+	server.notify(peers,
+		fmt.Sprintf("%s is now known as %s", old, client.nickname),
+		fmt.Sprintf(":%s NICK :%s", prefix, client.nickname))
+}
+
+// assignGuestName gives client the next free Anonymous-N nickname. The
+// caller must hold mutex.
+func (server *ChatServer) assignGuestName(client *Client) {
+	for {
+		server.nextGuest++
+		name := fmt.Sprintf("Anonymous-%d", server.nextGuest)
+		if _, taken := server.nicks[strings.ToLower(name)]; !taken {
+			client.nickname = name
+			server.nicks[strings.ToLower(name)] = client
+			return
+		}
+	}
+}
+
+// rename changes the nickname of client, unless another client uses it
+// in any letter case, and returns the previous one.
+func (server *ChatServer) rename(client *Client, nick string) (string, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	old := client.nickname
+	if owner, taken := server.nicks[strings.ToLower(nick)]; taken && owner != client {
+		return old, fmt.Errorf("The nickname %s is already in use", nick)
+	}
+	delete(server.nicks, strings.ToLower(old))
+	server.nicks[strings.ToLower(nick)] = client
+	client.nickname = nick
+	return old, nil
+}
+
+func (server *ChatServer) nameOf(client *Client) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return client.nickname
+}
+
+// findClient returns the client using nick and its nickname as
+// currently spelled, or nil.
+func (server *ChatServer) findClient(nick string) (*Client, string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	c, ok := server.nicks[strings.ToLower(nick)]
+	if !ok {
+		return nil, ""
+	}
+	return c, c.nickname
+}
+
 func (server *ChatServer) handleClient(client *Client) {
+	server.mutex.Lock()
+	topic := server.topic
+	server.mutex.Unlock()
+	if topic != "" {
+		client.send("Topic: %s", topic)
+	}
+
 	reader := bufio.NewReader(client.conn)
 	for {
 		message, err := reader.ReadString('\n')
 		if err != nil {
-			server.unregister <- client
-			client.conn.Close()
+			server.depart(client)
+			client.close()
 			return
 		}
-		server.broadcast <- fmt.Sprintf("%s: %s", client.nickname, message)
+		message = strings.TrimRight(message, "\r\n")
+
+		if strings.HasPrefix(message, "/") {
+			server.command(client, message)
+			continue
+		}
+		if server.checkMuted(client) {
+			continue
+		}
+		server.say(client, defaultChannel, "PRIVMSG", message)
 	}
 }
 
 func main() {
+	adminPassword := flag.String("admin-password", os.Getenv("CHAT_ADMIN_PASSWORD"), "password for /oper to become admin (default $CHAT_ADMIN_PASSWORD)")
+	moderatorPassword := flag.String("moderator-password", os.Getenv("CHAT_MODERATOR_PASSWORD"), "password for /oper to become moderator (default $CHAT_MODERATOR_PASSWORD)")
+	bansFile := flag.String("bans-file", "", "file persisting nickname and IP bans (bans are kept in memory unless set)")
+	auditLog := flag.String("audit-log", "", "file recording moderation actions (logged to stderr unless set)")
+	ircAddr := flag.String("irc-addr", ":6667", "address to accept IRC clients on (empty disables IRC)")
+	muteByIP := flag.Bool("mute-by-ip", false, "also apply /mute to other connections from the muted user's address, except operators")
+	flag.Parse()
+
+	mod, err := newModeration(*adminPassword, *moderatorPassword, *bansFile, *auditLog, *muteByIP)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+
 	listener, err := net.Listen("tcp", ":8080")
 	if err != nil {
 		log.Fatalf("Error starting server: %s", err)
 	}
 	defer listener.Close()
 
-	server := NewServer()
+	server := NewServer(mod)
 	go server.run()
 
 	fmt.Println("Server started on :8080")
 
+	if *ircAddr != "" {
+		ircListener, err := net.Listen("tcp", *ircAddr)
+		if err != nil {
+			log.Fatalf("Error starting IRC listener: %s", err)
+		}
+		defer ircListener.Close()
+
+		go server.serveIRC(ircListener)
+		fmt.Printf("Accepting IRC clients on %s\n", *ircAddr)
+	}
+
+	server.serve(listener)
+}
+
+func (server *ChatServer) serve(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -90,12 +534,26 @@ func main() {
 			continue
 		}
 
-		client := &Client{
-			conn:     conn,
-			nickname: fmt.Sprintf("Anonymous-%d", len(server.clients)+1),
+		client := newClient(conn, nil)
+		if !server.admit(client) {
+			continue
 		}
 
 		server.register <- client
-		go server.handleClient(client)
 	}
 }
+
+// admit turns client away if its address is banned.
+func (server *ChatServer) admit(client *Client) bool {
+	b, banned := server.mod.banned("", client.ip)
+	if !banned {
+		return true
+	}
+	if b.Until.IsZero() {
+		client.send("You are banned%s", suffix(b.Reason))
+	} else {
+		client.send("You are banned until %s%s", b.Until.Format(time.RFC3339), suffix(b.Reason))
+	}
+	client.close()
+	return false
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles are granted for the lifetime of a connection by /oper with the
+// admin or moderator password. Moderators may kick, mute and set the
+// topic; admins may also ban. Nobody can act on a client whose role is
+// equal to or higher than their own.
+type role int
+
+const (
+	roleUser role = iota
+	roleModerator
+	roleAdmin
+)
+
+func (r role) String() string {
+	switch r {
+	case roleAdmin:
+		return "admin"
+	case roleModerator:
+		return "moderator"
+	default:
+		return "user"
+	}
+}
+
+// ban bans either a nickname or an IP address; a zero Until is
+// permanent.
+type ban struct {
+	Nick    string    `json:"nick,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Until   time.Time `json:"until,omitempty"`
+	By      string    `json:"by"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (b ban) active(now time.Time) bool {
+	return b.Until.IsZero() || now.Before(b.Until)
+}
+
+func (b ban) matches(nick, ip string) bool {
+	return (b.Nick != "" && strings.EqualFold(b.Nick, nick)) || (b.IP != "" && b.IP == ip)
+}
+
+type moderation struct {
+	adminPassword     string
+	moderatorPassword string
+
+	mu       sync.Mutex
+	bans     []ban
+	bansFile string
+	// Mutes silence the muted connection. With muteByIP they also
+	// cover its address so that reconnecting does not lift them, but
+	// never the moderator who issued them or any other operator.
+	mutes    map[*Client]time.Time
+	muteByIP bool
+	ipMutes  map[string]ipMute
+
+	audit *log.Logger
+}
+
+// ipMute is a mute of every connection from an address except the
+// issuer's.
+type ipMute struct {
+	until  time.Time
+	issuer *Client
+}
+
+func newModeration(adminPassword, moderatorPassword, bansFile, auditFile string, muteByIP bool) (*moderation, error) {
+	m := &moderation{
+		adminPassword:     adminPassword,
+		moderatorPassword: moderatorPassword,
+		bansFile:          bansFile,
+		mutes:             make(map[*Client]time.Time),
+		muteByIP:          muteByIP,
+		ipMutes:           make(map[string]ipMute),
+		audit:             log.New(os.Stderr, "audit: ", log.LstdFlags|log.LUTC),
+	}
+
+	if bansFile != "" {
+		data, err := os.ReadFile(bansFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("could not read bans file: %w", err)
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &m.bans); err != nil {
+				return nil, fmt.Errorf("could not parse bans file: %w", err)
+			}
+		}
+	}
+
+	if auditFile != "" {
+		f, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("could not open audit log: %w", err)
+		}
+		m.audit = log.New(f, "", log.LstdFlags|log.LUTC)
+	}
+	return m, nil
+}
+
+// oper returns the role granted by password, if any. An unset password
+// grants nothing.
+func (m *moderation) oper(password string) role {
+	match := func(want string) bool {
+		return want != "" && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	}
+	switch {
+	case match(m.adminPassword):
+		return roleAdmin
+	case match(m.moderatorPassword):
+		return roleModerator
+	default:
+		return roleUser
+	}
+}
+
+// record appends an audit entry. Refused attempts are recorded with
+// detail "denied".
+func (m *moderation) record(actor *Client, action, target, detail string) {
+	m.audit.Printf("actor=%q ip=%s action=%s target=%q detail=%q", actor.nickname, actor.ip, action, target, detail)
+}
+
+// banned returns the active ban matching nick or ip.
+func (m *moderation) banned(nick, ip string) (ban, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, b := range m.bans {
+		if b.active(now) && b.matches(nick, ip) {
+			return b, true
+		}
+	}
+	return ban{}, false
+}
+
+// addBan records b, replacing an earlier ban of the same target, and
+// saves the list. removeBan lifts the bans of nick or ip and reports
+// whether there were any.
+func (m *moderation) addBan(b ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dropBans(b.Nick, b.IP)
+	m.bans = append(m.bans, b)
+	return m.saveBans()
+}
+
+func (m *moderation) removeBan(nick, ip string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dropBans(nick, ip) {
+		return false, nil
+	}
+	return true, m.saveBans()
+}
+
+// dropBans removes the bans of nick or ip and any that have expired.
+// The caller must hold mu.
+func (m *moderation) dropBans(nick, ip string) bool {
+	now := time.Now()
+	found := false
+	m.bans = slices.DeleteFunc(m.bans, func(b ban) bool {
+		if b.matches(nick, ip) {
+			found = found || b.active(now)
+			return true
+		}
+		return !b.active(now)
+	})
+	return found
+}
+
+// saveBans writes the ban list to a temporary file and renames it into
+// place, so a crash never leaves a truncated list. The caller must hold
+// mu.
+func (m *moderation) saveBans() error {
+	if m.bansFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.bansFile + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("could not save bans: %w", err)
+	}
+	if err := os.Rename(tmp, m.bansFile); err != nil {
+		return fmt.Errorf("could not save bans: %w", err)
+	}
+	return nil
+}
+
+// mutedFor returns how much longer c is muted, rounded up to a second.
+// Operators are exempt from mutes of their address.
+func (m *moderation) mutedFor(c *Client, operator bool) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	until, ok := m.mutes[c]
+	if ok && !until.After(now) {
+		delete(m.mutes, c)
+	}
+	if im, ok := m.ipMutes[c.ip]; ok {
+		switch {
+		case !im.until.After(now):
+			delete(m.ipMutes, c.ip)
+		case c != im.issuer && !operator && im.until.After(until):
+			until = im.until
+		}
+	}
+
+	left := until.Sub(now)
+	if left <= 0 {
+		return 0
+	}
+	return (left + time.Second - 1).Truncate(time.Second)
+}
+
+// setMute mutes target until the given time, or unmutes it for a zero
+// time. issuer is the moderator doing so.
+func (m *moderation) setMute(issuer, target *Client, until time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if until.IsZero() {
+		delete(m.mutes, target)
+		delete(m.ipMutes, target.ip)
+		return
+	}
+	m.mutes[target] = until
+	if m.muteByIP {
+		m.ipMutes[target.ip] = ipMute{until: until, issuer: issuer}
+	}
+}
+
+// forget drops the mute of a disconnected client.
+func (m *moderation) forget(c *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.mutes, c)
+}
+
+func init() {
+	registerCommand("oper", "<password>", "become a moderator or admin", (*ChatServer).operCommand)
+	registerCommand("topic", "[text|-]", "show the topic, or as a moderator set or clear it", (*ChatServer).topicCommand)
+	registerCommand("kick", "<nick> [reason]", "disconnect a user (moderators)", (*ChatServer).kickCommand)
+	registerCommand("mute", "<nick> <duration> [reason]", "silence a user, e.g. /mute bob 10m (moderators)", (*ChatServer).muteCommand)
+	registerCommand("unmute", "<nick>", "lift a mute (moderators)", (*ChatServer).unmuteCommand)
+	registerCommand("ban", "<nick|ip> [duration] [reason]", "ban a nickname or address, permanently without a duration (admins)", (*ChatServer).banCommand)
+	registerCommand("unban", "<nick|ip>", "lift a ban (admins)", (*ChatServer).unbanCommand)
+}
+
+func (server *ChatServer) operCommand(client *Client, password string) {
+	r := server.mod.oper(password)
+	if r == roleUser {
+		server.mod.record(client, "oper", "", "denied")
+		time.Sleep(time.Second)
+		client.send("Incorrect password")
+		return
+	}
+
+	server.mutex.Lock()
+	client.role = r
+	server.mutex.Unlock()
+
+	server.mod.record(client, "oper", r.String(), "")
+	client.send("You are now %s", r)
+}
+
+// authorize checks that client has at least need and outranks target,
+// which may be nil, and tells client why not otherwise. Refusals are
+// audited under targetName.
+func (server *ChatServer) authorize(client *Client, action string, need role, target *Client, targetName string) bool {
+	server.mutex.Lock()
+	have := client.role
+	var targetRole role
+	if target != nil {
+		targetRole = target.role
+	}
+	server.mutex.Unlock()
+
+	var reason string
+	switch {
+	case have < need:
+		reason = fmt.Sprintf("/%s requires the %s role", action, need)
+	case target == client:
+		reason = fmt.Sprintf("You cannot %s yourself", action)
+	case target != nil && targetRole >= have:
+		reason = fmt.Sprintf("%s has the %s role", targetName, targetRole)
+	}
+	if reason != "" {
+		server.mod.record(client, action, targetName, "denied")
+		client.send("%s", reason)
+		return false
+	}
+	return true
+}
+
+func (server *ChatServer) topicCommand(client *Client, topic string) {
+	if topic == "" {
+		server.mutex.Lock()
+		current := server.topic
+		server.mutex.Unlock()
+
+		if current == "" {
+			client.send("No topic is set")
+		} else {
+			client.send("Topic: %s", current)
+		}
+		return
+	}
+	if !server.authorize(client, "topic", roleModerator, nil, "") {
+		return
+	}
+
+	if topic == "-" {
+		topic = ""
+	}
+	server.mutex.Lock()
+	server.topic = topic
+	server.mutex.Unlock()
+
+	server.mod.record(client, "topic", "", topic)
+	if topic == "" {
+		server.announce(fmt.Sprintf("%s cleared the topic", client.nickname))
+	} else {
+		server.announce(fmt.Sprintf("%s set the topic: %s", client.nickname, topic))
+	}
+}
+
+func (server *ChatServer) kickCommand(client *Client, args string) {
+	nick, reason, _ := strings.Cut(args, " ")
+	if nick == "" {
+		client.send("Usage: /kick <nick> [reason]")
+		return
+	}
+	target, name := server.findClient(nick)
+	if target == nil {
+		client.send("No such user: %s", nick)
+		return
+	}
+	if !server.authorize(client, "kick", roleModerator, target, name) {
+		return
+	}
+
+	server.mod.record(client, "kick", name, strings.TrimSpace(reason))
+	reason = suffix(strings.TrimSpace(reason))
+	target.send("You were kicked by %s%s", client.nickname, reason)
+	target.close()
+	server.announce(fmt.Sprintf("%s was kicked by %s%s", name, client.nickname, reason))
+}
+
+func (server *ChatServer) muteCommand(client *Client, args string) {
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) < 2 {
+		client.send("Usage: /mute <nick> <duration> [reason]")
+		return
+	}
+	d, err := time.ParseDuration(fields[1])
+	if err != nil || d <= 0 {
+		client.send("Invalid duration %q, use e.g. 10m", fields[1])
+		return
+	}
+	target, name := server.findClient(fields[0])
+	if target == nil {
+		client.send("No such user: %s", fields[0])
+		return
+	}
+	if !server.authorize(client, "mute", roleModerator, target, name) {
+		return
+	}
+
+	reason := ""
+	if len(fields) == 3 {
+		reason = suffix(strings.TrimSpace(fields[2]))
+	}
+	server.mod.setMute(client, target, time.Now().Add(d))
+	server.mod.record(client, "mute", name, fmt.Sprintf("%v%s", d, reason))
+	server.announce(fmt.Sprintf("%s was muted by %s for %v%s", name, client.nickname, d, reason))
+}
+
+func (server *ChatServer) unmuteCommand(client *Client, nick string) {
+	target, name := server.findClient(nick)
+	if target == nil {
+		client.send("No such user: %s", nick)
+		return
+	}
+	if !server.authorize(client, "unmute", roleModerator, target, name) {
+		return
+	}
+
+	server.mod.setMute(client, target, time.Time{})
+	server.mod.record(client, "unmute", name, "")
+	server.announce(fmt.Sprintf("%s was unmuted by %s", name, client.nickname))
+}
+
+// banCommand bans a nickname or an IP address, optionally for a
+// duration given before the reason, and disconnects matching clients.
+func (server *ChatServer) banCommand(client *Client, args string) {
+	target, rest, _ := strings.Cut(args, " ")
+	if target == "" {
+		client.send("Usage: /ban <nick|ip> [duration] [reason]")
+		return
+	}
+	b := ban{By: client.nickname, Created: time.Now().UTC()}
+	if addr, err := netip.ParseAddr(target); err == nil {
+		b.IP = addr.Unmap().String()
+	} else {
+		b.Nick = target
+	}
+
+	first, reason, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	if d, err := time.ParseDuration(first); err == nil && d > 0 {
+		b.Until = b.Created.Add(d)
+		rest = reason
+	}
+	b.Reason = strings.TrimSpace(rest)
+
+	online, _ := server.findClient(b.Nick)
+	if !server.authorize(client, "ban", roleAdmin, online, target) {
+		return
+	}
+	if err := server.mod.addBan(b); err != nil {
+		log.Printf("Error saving bans: %s", err)
+		client.send("Could not save the ban")
+		return
+	}
+
+	server.mod.record(client, "ban", target, b.Reason)
+	server.mutex.Lock()
+	for c := range server.clients {
+		if c != client && c.role < client.role && b.matches(c.nickname, c.ip) {
+			c.send("You were banned by %s%s", client.nickname, suffix(b.Reason))
+			c.close()
+		}
+	}
+	server.mutex.Unlock()
+	server.announce(fmt.Sprintf("%s was banned by %s%s", target, client.nickname, suffix(b.Reason)))
+}
+
+func (server *ChatServer) unbanCommand(client *Client, target string) {
+	if target == "" {
+		client.send("Usage: /unban <nick|ip>")
+		return
+	}
+	if !server.authorize(client, "unban", roleAdmin, nil, target) {
+		return
+	}
+
+	nick, ip := target, ""
+	if addr, err := netip.ParseAddr(target); err == nil {
+		nick, ip = "", addr.Unmap().String()
+	}
+	found, err := server.mod.removeBan(nick, ip)
+	if err != nil {
+		log.Printf("Error saving bans: %s", err)
+		client.send("Could not save the ban list")
+		return
+	}
+	if !found {
+		client.send("%s is not banned", target)
+		return
+	}
+	server.mod.record(client, "unban", target, "")
+	client.send("%s is no longer banned", target)
+}
+
+// remoteIP returns the address conn is connected from, without port.
+func remoteIP(conn net.Conn) string {
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return addr.Addr().Unmap().WithZone("").String()
+}
+
+func suffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
@@ -2,33 +2,69 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
-type Message struct {
-	Type    string      `json:"type"`
-	Content interface{} `json:"content"`
-}
+const prompt = "Enter message, /join <room>, /create <room>, /leave [room], /room <room>, /rooms, /history [n], /nick <name>, /dm <nick> <text>, /topic [text|-], /send <nick> <file>, /modhelp (or 'quit' to exit):"
+
+// moderatorHelp lists the commands that need the moderator or admin role.
+const moderatorHelp = `Moderator commands:
+  /kick <nick> [reason]
+  /mute <nick> <duration> [reason]    e.g. /mute bob 10m spamming
+  /unmute <nick>
+  /ban <nick|ip> [duration] [reason]  admins only; permanent without a duration
+  /unban <nick|ip>                    admins only`
 
+const (
+	// defaultRoom is joined by the server on connect.
+	defaultRoom = "lobby"
+	// replayCount is the number of messages replayed after joining.
+	replayCount = 20
+)
+
+// Usage:
+//
+//	go run . -user alice            (password from $CHAT_PASSWORD or prompted)
+//	go run . -token "$CHAT_TOKEN"
 func main() {
-	conn, err := net.Dial("tcp", "localhost:8080")
-	if err != nil {
-		log.Printf("Error dialing: %s", err.Error())
+	addr := flag.String("addr", "localhost:8080", "chat server address")
+	user := flag.String("user", "", "username for password login")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "bearer token issued by the server (default $CHAT_TOKEN)")
+	downloadDir := flag.String("download-dir", ".", "directory to save received files in")
+	flag.Parse()
+
+	scanner := bufio.NewScanner(os.Stdin)
+
+	auth := AuthContent{Token: *token}
+	if *user != "" {
+		auth = AuthContent{Username: *user, Password: os.Getenv("CHAT_PASSWORD")}
+		if auth.Password == "" {
+			fmt.Print("Password: ")
+			if !scanner.Scan() {
+				log.Printf("Error reading password: %s", scanner.Err())
+				return
+			}
+			auth.Password = scanner.Text()
+		}
+	}
+	if auth.Token == "" && auth.Username == "" {
+		log.Printf("Error: -user or -token is required")
 		return
 	}
 
-	defer conn.Close()
+	sess := newSession(*addr, auth, *downloadDir)
+	go sess.run()
 
-	go receiveMessages(conn)
-
-	scanner := bufio.NewScanner(os.Stdin)
+	in := &input{room: defaultRoom, files: sess.files}
 	for {
-		fmt.Println("Enter message (or 'quit' to exit):")
+		fmt.Println(prompt)
 		if !scanner.Scan() {
 			log.Printf("Error reading from stdin: %s", scanner.Err())
 			break
@@ -39,30 +75,160 @@ func main() {
 			log.Println("Exiting...")
 			return
 		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
 
-		msg := Message{
-			Type:    "chat",
-			Content: text,
+		msgs, err := in.parse(text)
+		if err != nil {
+			fmt.Println(err)
+			continue
 		}
 
-		encoder := json.NewEncoder(conn)
-		if err := encoder.Encode(msg); err != nil {
-			fmt.Println("Error encoding message:", err)
-			return
+		for _, msg := range msgs {
+			sess.submit(msg)
 		}
 	}
 }
 
-func receiveMessages(conn net.Conn) {
-	decoder := json.NewDecoder(conn)
-	for {
-		var msg Message
-		if err := decoder.Decode(&msg); err != nil {
-			fmt.Println("Connection closed by server")
-			os.Exit(0)
-		}
+// input tracks the room that plain text is sent to.
+type input struct {
+	room  string
+	files *fileTransfers
+}
 
-		fmt.Printf("\nReceived: %+v\n", msg)
-		fmt.Print("Enter message (or 'quit' to exit): ")
+// parse turns a line typed by the user into the protocol messages to
+// send, if any.
+func (in *input) parse(text string) ([]Message, error) {
+	cmd, rest, _ := strings.Cut(text, " ")
+	arg := strings.TrimSpace(rest)
+	switch cmd {
+	case "/join", "/create":
+		if arg == "" {
+			return nil, fmt.Errorf("usage: %s <room>", cmd)
+		}
+		in.room = arg
+		if cmd == "/create" {
+			return []Message{newMessage(TypeCreate, CreateContent{Room: arg})}, nil
+		}
+		return []Message{
+			newMessage(TypeJoin, JoinContent{Room: arg}),
+			newMessage(TypeHistory, HistoryContent{Room: arg, Last: replayCount}),
+		}, nil
+	case "/leave":
+		if arg == "" {
+			arg = in.room
+		}
+		if arg == in.room {
+			in.room = defaultRoom
+		}
+		return []Message{newMessage(TypeLeave, LeaveContent{Room: arg})}, nil
+	case "/room":
+		if arg != "" {
+			in.room = arg
+		}
+		fmt.Printf("Sending to %s\n", in.room)
+		return nil, nil
+	case "/rooms":
+		return []Message{{Type: TypeList}}, nil
+	case "/history":
+		n := replayCount
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n <= 0 {
+				return nil, fmt.Errorf("usage: /history [count]")
+			}
+		}
+		return []Message{newMessage(TypeHistory, HistoryContent{Room: in.room, Last: n})}, nil
+	case "/nick":
+		if arg == "" {
+			return nil, fmt.Errorf("usage: /nick <name>")
+		}
+		return []Message{newMessage(TypeNick, NickContent{Nick: arg})}, nil
+	case "/topic":
+		content := TopicContent{Room: in.room}
+		switch arg {
+		case "":
+		case "-":
+			content.Topic = new(string)
+		default:
+			content.Topic = &arg
+		}
+		return []Message{newMessage(TypeTopic, content)}, nil
+	case "/kick":
+		nick, reason, _ := strings.Cut(arg, " ")
+		if nick == "" {
+			return nil, fmt.Errorf("usage: /kick <nick> [reason]")
+		}
+		return []Message{newMessage(TypeKick, KickContent{Nick: nick, Reason: strings.TrimSpace(reason)})}, nil
+	case "/mute":
+		fields := strings.SplitN(arg, " ", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("usage: /mute <nick> <duration> [reason]")
+		}
+		content := MuteContent{Nick: fields[0], Duration: fields[1]}
+		if len(fields) == 3 {
+			content.Reason = strings.TrimSpace(fields[2])
+		}
+		return []Message{newMessage(TypeMute, content)}, nil
+	case "/unmute":
+		if arg == "" {
+			return nil, fmt.Errorf("usage: /unmute <nick>")
+		}
+		return []Message{newMessage(TypeUnmute, MuteContent{Nick: arg})}, nil
+	case "/ban", "/unban":
+		target, rest, _ := strings.Cut(arg, " ")
+		if target == "" {
+			return nil, fmt.Errorf("usage: %s <nick|ip>", cmd)
+		}
+		var content BanContent
+		if _, err := netip.ParseAddr(target); err == nil {
+			content.IP = target
+		} else {
+			content.Nick = target
+		}
+		if cmd == "/ban" {
+			// An optional duration comes before the reason.
+			first, reason, _ := strings.Cut(strings.TrimSpace(rest), " ")
+			if _, err := time.ParseDuration(first); err == nil {
+				content.Duration, rest = first, reason
+			}
+			content.Reason = strings.TrimSpace(rest)
+			return []Message{newMessage(TypeBan, content)}, nil
+		}
+		return []Message{newMessage(TypeUnban, content)}, nil
+	case "/send":
+		to, path, ok := strings.Cut(arg, " ")
+		if !ok || strings.TrimSpace(path) == "" {
+			return nil, fmt.Errorf("usage: /send <nick> <file>")
+		}
+		msg, err := in.files.offer(to, strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		return []Message{msg}, nil
+	case "/accept":
+		msg, err := in.files.accept(arg)
+		if err != nil {
+			return nil, err
+		}
+		return []Message{msg}, nil
+	case "/decline", "/cancel":
+		msg, err := in.files.cancel(arg)
+		if err != nil {
+			return nil, err
+		}
+		return []Message{msg}, nil
+	case "/modhelp":
+		fmt.Println(moderatorHelp)
+		return nil, nil
+	case "/dm", "/msg":
+		to, body, ok := strings.Cut(arg, " ")
+		if !ok || strings.TrimSpace(body) == "" {
+			return nil, fmt.Errorf("usage: /dm <nick> <text>")
+		}
+		return []Message{newMessage(TypeDM, DMContent{To: to, Text: body})}, nil
+	default:
+		return []Message{newMessage(TypeChat, ChatContent{Room: in.room, Text: text})}, nil
 	}
 }
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message types, mirroring tcp-chat-server.
+const (
+	TypeAuth    = "auth"
+	TypeJoin    = "join"
+	TypeLeave   = "leave"
+	TypeCreate  = "create"
+	TypeList    = "list"
+	TypeRooms   = "rooms"
+	TypeHistory = "history"
+	TypeNick    = "nick"
+	TypeChat    = "chat"
+	TypeDM      = "dm"
+	TypeSystem  = "system"
+	TypeError   = "error"
+	TypeAck     = "ack"
+	TypeTopic   = "topic"
+	TypeKick    = "kick"
+	TypeMute    = "mute"
+	TypeUnmute  = "unmute"
+	TypeBan     = "ban"
+	TypeUnban   = "unban"
+
+	TypeFileOffer  = "file_offer"
+	TypeFileAccept = "file_accept"
+	TypeFileChunk  = "file_chunk"
+	TypeFileAck    = "file_ack"
+	TypeFileDone   = "file_done"
+	TypeFileCancel = "file_cancel"
+)
+
+type Message struct {
+	ID       uint64          `json:"id,omitempty"`
+	ClientID string          `json:"client_id,omitempty"`
+	From     string          `json:"from,omitempty"`
+	Time     *time.Time      `json:"time,omitempty"`
+	Type     string          `json:"type"`
+	Content  json.RawMessage `json:"content,omitempty"`
+}
+
+type AuthContent struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+type JoinContent struct {
+	Room string `json:"room"`
+	Nick string `json:"nick,omitempty"`
+}
+
+type LeaveContent struct {
+	Room string `json:"room"`
+	Nick string `json:"nick,omitempty"`
+}
+
+type CreateContent struct {
+	Room string `json:"room"`
+}
+
+type RoomsContent struct {
+	Rooms []RoomInfo `json:"rooms"`
+}
+
+type HistoryContent struct {
+	Room     string    `json:"room"`
+	Last     int       `json:"last,omitempty"`
+	Since    uint64    `json:"since,omitempty"`
+	Messages []Message `json:"messages,omitempty"`
+	More     bool      `json:"more,omitempty"`
+}
+
+type RoomInfo struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type NickContent struct {
+	Old  string `json:"old,omitempty"`
+	Nick string `json:"nick"`
+}
+
+type ChatContent struct {
+	Room string `json:"room"`
+	From string `json:"from,omitempty"`
+	Text string `json:"text"`
+}
+
+type DMContent struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+// TopicContent queries the topic of Room when Topic is nil and sets it
+// otherwise.
+type TopicContent struct {
+	Room  string  `json:"room"`
+	Topic *string `json:"topic,omitempty"`
+	SetBy string  `json:"set_by,omitempty"`
+}
+
+type KickContent struct {
+	Nick   string `json:"nick"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type MuteContent struct {
+	Nick     string `json:"nick"`
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type BanContent struct {
+	Nick     string `json:"nick,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type FileOfferContent struct {
+	ID     string `json:"id"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type FileAcceptContent struct {
+	ID string `json:"id"`
+}
+
+type FileChunkContent struct {
+	ID   string `json:"id"`
+	Seq  uint64 `json:"seq"`
+	Data []byte `json:"data"`
+}
+
+type FileAckContent struct {
+	ID  string `json:"id"`
+	Seq uint64 `json:"seq"`
+}
+
+type FileDoneContent struct {
+	ID string `json:"id"`
+}
+
+type FileCancelContent struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// isFileMessage reports whether typ belongs to a file transfer.
+func isFileMessage(typ string) bool {
+	switch typ {
+	case TypeFileOffer, TypeFileAccept, TypeFileChunk, TypeFileAck, TypeFileDone, TypeFileCancel:
+		return true
+	}
+	return false
+}
+
+type SystemContent struct {
+	Text string `json:"text"`
+}
+
+type AckContent struct {
+	ClientID  string `json:"client_id"`
+	ID        uint64 `json:"id"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+type ErrorContent struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newMessage(typ string, content any) Message {
+	raw, err := json.Marshal(content)
+	if err != nil {
+		// Payloads are plain structs; marshaling them cannot fail.
+		panic(fmt.Sprintf("encoding %s content: %v", typ, err))
+	}
+	return Message{Type: typ, Content: raw}
+}
+
+// render formats a message from the server for display.
+func render(msg Message) (string, error) {
+	switch msg.Type {
+	case TypeAuth:
+		var c AuthContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("*** Logged in as %s", c.Username), nil
+	case TypeJoin:
+		var c JoinContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("[%s] * %s joined", c.Room, c.Nick), nil
+	case TypeLeave:
+		var c LeaveContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("[%s] * %s left", c.Room, c.Nick), nil
+	case TypeNick:
+		var c NickContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("* %s is now known as %s", c.Old, c.Nick), nil
+	case TypeChat:
+		var c ChatContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s[%s] <%s> %s", timestamp(msg), c.Room, sender(c.From, msg.From), c.Text), nil
+	case TypeRooms:
+		var c RoomsContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		if len(c.Rooms) == 0 {
+			return "*** No rooms", nil
+		}
+		var b strings.Builder
+		b.WriteString("*** Rooms:")
+		for _, r := range c.Rooms {
+			fmt.Fprintf(&b, "\n  %s (%d): %s", r.Name, len(r.Members), strings.Join(r.Members, ", "))
+		}
+		return b.String(), nil
+	case TypeHistory:
+		var c HistoryContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "--- history of %s (%d messages) ---", c.Room, len(c.Messages))
+		for _, m := range c.Messages {
+			line, err := render(m)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString("\n" + line)
+		}
+		if c.More {
+			fmt.Fprintf(&b, "\n--- more history follows ---")
+		} else {
+			fmt.Fprintf(&b, "\n--- end of history ---")
+		}
+		return b.String(), nil
+	case TypeDM:
+		var c DMContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s[dm from %s] %s", timestamp(msg), sender(c.From, msg.From), c.Text), nil
+	case TypeTopic:
+		var c TopicContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		if c.Topic == nil || *c.Topic == "" {
+			return fmt.Sprintf("[%s] * No topic is set", c.Room), nil
+		}
+		return fmt.Sprintf("[%s] * Topic: %s (set by %s)", c.Room, *c.Topic, c.SetBy), nil
+	case TypeSystem:
+		var c SystemContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("*** %s", c.Text), nil
+	case TypeError:
+		var c ErrorContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("! error (%s): %s", c.Code, c.Message), nil
+	default:
+		return fmt.Sprintf("? %s: %s", msg.Type, msg.Content), nil
+	}
+}
+
+// sender shows a nickname together with the server-verified user name
+// when the two differ, so a nickname cannot pass for another user.
+func sender(nick, user string) string {
+	if user == "" || user == nick {
+		return nick
+	}
+	return nick + " (" + user + ")"
+}
+
+// timestamp formats the server time of msg in local time, if present.
+func timestamp(msg Message) string {
+	if msg.Time == nil {
+		return ""
+	}
+	return msg.Time.Local().Format("15:04") + " "
+}
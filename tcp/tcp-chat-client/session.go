@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	reconnectMin = time.Second
+	reconnectMax = 30 * time.Second
+
+	// A message the server turns away as rate limited is resent after
+	// retryMin, doubling up to retryMax with every further refusal.
+	retryMin = time.Second
+	retryMax = 30 * time.Second
+
+	// After a reconnect the first resendBurst pending messages go out at
+	// once and the rest one per resendInterval, which stays under the
+	// server's default flood limit.
+	resendBurst    = 5
+	resendInterval = 250 * time.Millisecond
+)
+
+// errAuth is returned by connect when the server rejects the login;
+// retrying would not help.
+var errAuth = errors.New("authentication rejected")
+
+// errRemoved is returned by receive when a moderator kicked or banned
+// the user; reconnecting would defeat the point.
+var errRemoved = errors.New("removed from the server")
+
+// session keeps a logical chat session alive across reconnects. Chat
+// and direct messages are tagged with a client ID and kept until the
+// server acknowledges them, so they are retransmitted after a reconnect
+// or, when rate limited, after a backoff; the server drops any it
+// already delivered. The highest message ID seen
+// per room is used to catch up on what was missed while disconnected.
+type session struct {
+	addr string
+	auth AuthContent
+
+	mu       sync.Mutex
+	encoder  *json.Encoder // nil while disconnected
+	user     string
+	pending  []Message      // unacknowledged, in send order
+	requests []Message      // resume joins and history requests awaiting a reply
+	retries  map[string]int // rate limited attempts per pending client ID
+	rooms    map[string]bool
+	lastSeen map[string]uint64
+	replays  map[string]replay // rooms whose history reply is on its way
+	idPrefix string
+	idSeq    uint64
+
+	files *fileTransfers
+}
+
+func newSession(addr string, auth AuthContent, downloadDir string) *session {
+	var prefix [6]byte
+	rand.Read(prefix[:])
+
+	s := &session{
+		addr:     addr,
+		auth:     auth,
+		rooms:    map[string]bool{defaultRoom: true},
+		lastSeen: make(map[string]uint64),
+		replays:  make(map[string]replay),
+		retries:  make(map[string]int),
+		idPrefix: hex.EncodeToString(prefix[:]),
+	}
+	s.files = newFileTransfers(downloadDir, s.submit)
+	return s
+}
+
+// submit sends msg, or queues it until the next reconnect if it is a
+// chat or direct message and the connection is down.
+func (s *session) submit(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg.Type == TypeChat || msg.Type == TypeDM {
+		msg.ClientID = s.nextClientID()
+		s.pending = append(s.pending, msg)
+	}
+	var req HistoryContent
+	if msg.Type == TypeHistory && json.Unmarshal(msg.Content, &req) == nil {
+		if _, ok := s.replays[req.Room]; !ok {
+			s.replays[req.Room] = replay{floor: s.lastSeen[req.Room]}
+		}
+	}
+
+	if s.encoder == nil {
+		fmt.Println("Not connected; message will be sent after reconnecting")
+		return
+	}
+	// A failed write shows up as a read error in run, which reconnects.
+	s.encoder.Encode(msg)
+}
+
+// run connects and reads messages until authentication fails,
+// reconnecting with backoff whenever the connection drops.
+func (s *session) run() {
+	backoff := reconnectMin
+	for {
+		conn, decoder, err := s.connect()
+		if errors.Is(err, errAuth) {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Printf("Error connecting: %s; retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, reconnectMax)
+			continue
+		}
+		backoff = reconnectMin
+
+		err = s.receive(decoder)
+		s.mu.Lock()
+		s.encoder = nil
+		s.mu.Unlock()
+		conn.Close()
+		s.files.abortAll()
+
+		if errors.Is(err, errRemoved) {
+			fmt.Printf("\n%v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("\nConnection lost (%v), reconnecting...\n", err)
+	}
+}
+
+// connect dials the server, logs in and resumes the session: it rejoins
+// rooms, requests the history missed since the last message seen in
+// each, and retransmits unacknowledged messages.
+func (s *session) connect() (net.Conn, *json.Decoder, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	if err := encoder.Encode(newMessage(TypeAuth, s.auth)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	var reply Message
+	if err := decoder.Decode(&reply); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if reply.Type != TypeAuth {
+		conn.Close()
+		line, _ := render(reply)
+		return nil, nil, fmt.Errorf("%w: %s", errAuth, line)
+	}
+	var authed AuthContent
+	json.Unmarshal(reply.Content, &authed)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user = authed.Username
+	fmt.Printf("\n*** Logged in as %s\n", s.user)
+
+	// Resume requests carry client IDs only so that a rate limited one
+	// can be told apart and retried.
+	for _, m := range s.requests {
+		delete(s.retries, m.ClientID)
+	}
+	s.requests = nil
+	clear(s.replays)
+	for room := range s.rooms {
+		if room != defaultRoom {
+			s.requests = append(s.requests, newMessage(TypeJoin, JoinContent{Room: room}))
+		}
+		req := HistoryContent{Room: room, Last: replayCount}
+		if since := s.lastSeen[room]; since > 0 {
+			req = HistoryContent{Room: room, Since: since}
+		}
+		s.requests = append(s.requests, newMessage(TypeHistory, req))
+		s.replays[room] = replay{floor: s.lastSeen[room]}
+	}
+	for i := range s.requests {
+		s.requests[i].ClientID = s.nextClientID()
+		if err := encoder.Encode(s.requests[i]); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	s.encoder = encoder
+	ids := make([]string, len(s.pending))
+	for i, m := range s.pending {
+		ids[i] = m.ClientID
+	}
+	go s.resend(encoder, ids)
+	return conn, decoder, nil
+}
+
+// resend retransmits the messages that were pending when encoder's
+// connection was made, paced so that a backlog does not trip the
+// server's flood limit. It stops once the connection is gone.
+func (s *session) resend(encoder *json.Encoder, ids []string) {
+	for i, id := range ids {
+		if i >= resendBurst {
+			time.Sleep(resendInterval)
+		}
+
+		s.mu.Lock()
+		if s.encoder != encoder {
+			s.mu.Unlock()
+			return
+		}
+		if m, ok := s.outstanding(id); ok {
+			encoder.Encode(m)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// nextClientID returns a new client ID. The caller must hold mu.
+func (s *session) nextClientID() string {
+	s.idSeq++
+	return fmt.Sprintf("%s-%d", s.idPrefix, s.idSeq)
+}
+
+func (s *session) receive(decoder *json.Decoder) error {
+	for {
+		var msg Message
+		if err := decoder.Decode(&msg); err != nil {
+			return err
+		}
+
+		var line string
+		var err error
+		if isFileMessage(msg.Type) {
+			// File messages are handled here, outside mu, since
+			// handling them may send replies.
+			if line, err = s.files.handle(msg); err == nil && line == "" {
+				continue
+			}
+		} else if !s.track(&msg) {
+			continue
+		} else {
+			line, err = render(msg)
+		}
+		if err != nil {
+			line = fmt.Sprintf("Malformed %s message: %v", msg.Type, err)
+		}
+
+		fmt.Printf("\n%s\n", line)
+		if removed(msg) {
+			return errRemoved
+		}
+		fmt.Print(prompt + " ")
+	}
+}
+
+// track updates the session state from msg and reports whether msg
+// should be displayed. Messages already seen before a reconnect are
+// filtered out of history replies.
+func (s *session) track(msg *Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch msg.Type {
+	case TypeAck:
+		var c AckContent
+		if json.Unmarshal(msg.Content, &c) == nil {
+			s.acknowledge(c.ClientID, c.ID)
+		}
+		return false
+
+	case TypeError:
+		var c ErrorContent
+		if msg.ClientID == "" || json.Unmarshal(msg.Content, &c) != nil {
+			break
+		}
+		switch c.Code {
+		case "unavailable":
+			s.abandon(msg.ClientID)
+		case "rate_limited":
+			s.retryLater(msg.ClientID)
+		default:
+			s.acknowledge(msg.ClientID, 0)
+			s.abandon(msg.ClientID)
+		}
+
+	case TypeJoin, TypeLeave:
+		var c JoinContent
+		if msg.From == s.user && json.Unmarshal(msg.Content, &c) == nil {
+			if msg.Type == TypeJoin {
+				s.rooms[c.Room] = true
+				s.answered(TypeJoin, c.Room)
+			} else {
+				delete(s.rooms, c.Room)
+				delete(s.replays, c.Room)
+			}
+		}
+
+	case TypeChat:
+		var c ChatContent
+		if json.Unmarshal(msg.Content, &c) == nil {
+			return s.see(c.Room, msg.ID)
+		}
+
+	case TypeHistory:
+		var c HistoryContent
+		if json.Unmarshal(msg.Content, &c) != nil {
+			return true
+		}
+		s.answered(TypeHistory, c.Room)
+		more := c.More && len(c.Messages) > 0 && s.encoder != nil
+		if more {
+			// Keep paging until caught up with the room.
+			last := c.Messages[len(c.Messages)-1].ID
+			s.encoder.Encode(newMessage(TypeHistory, HistoryContent{Room: c.Room, Since: last}))
+		}
+		fresh := c.Messages[:0]
+		for _, m := range c.Messages {
+			if s.replayed(c.Room, m.ID) {
+				fresh = append(fresh, m)
+			}
+		}
+		if !more {
+			delete(s.replays, c.Room)
+		}
+		c.Messages = fresh
+		*msg = newMessage(TypeHistory, c)
+	}
+	return true
+}
+
+// removed reports whether msg tells the user they were kicked or
+// banned.
+func removed(msg Message) bool {
+	var c ErrorContent
+	if msg.Type != TypeError || json.Unmarshal(msg.Content, &c) != nil {
+		return false
+	}
+	return c.Code == "kicked" || c.Code == "banned"
+}
+
+// replay is the part of a room's history to show once the history
+// reply arrives: messages after floor, the last one seen, and before
+// until, the first one received live since the history was requested.
+type replay struct {
+	floor, until uint64
+}
+
+// see records a chat message ID for room and reports whether it is new.
+func (s *session) see(room string, id uint64) bool {
+	if id == 0 {
+		return true
+	}
+	if r, ok := s.replays[room]; ok && (r.until == 0 || id < r.until) {
+		r.until = id
+		s.replays[room] = r
+	}
+	if id <= s.lastSeen[room] {
+		return false
+	}
+	s.lastSeen[room] = id
+	return true
+}
+
+// replayed records the ID of a message from room's history and reports
+// whether it is new. Live messages received while the history was on
+// its way have already moved lastSeen past it, so the replay window
+// decides instead.
+func (s *session) replayed(room string, id uint64) bool {
+	r, ok := s.replays[room]
+	if !ok || id == 0 {
+		return s.see(room, id)
+	}
+	if id <= r.floor || (r.until > 0 && id >= r.until) {
+		return false
+	}
+	r.floor = id
+	s.replays[room] = r
+	s.lastSeen[room] = max(s.lastSeen[room], id)
+	return true
+}
+
+// acknowledge removes the pending message sent as clientID. For chat
+// messages the assigned id also counts as seen, since the server does
+// not echo a sender's own messages.
+func (s *session) acknowledge(clientID string, id uint64) {
+	i := slices.IndexFunc(s.pending, func(m Message) bool { return m.ClientID == clientID })
+	if i < 0 {
+		return
+	}
+
+	if m := s.pending[i]; m.Type == TypeChat && id > 0 {
+		var c ChatContent
+		if json.Unmarshal(m.Content, &c) == nil {
+			s.see(c.Room, id)
+		}
+	}
+	s.pending = slices.Delete(s.pending, i, i+1)
+	delete(s.retries, clientID)
+}
+
+// answered drops the resume request of type typ for room once the
+// server has replied to it.
+func (s *session) answered(typ, room string) {
+	s.requests = slices.DeleteFunc(s.requests, func(m Message) bool {
+		var c struct {
+			Room string `json:"room"`
+		}
+		if m.Type != typ || json.Unmarshal(m.Content, &c) != nil || c.Room != room {
+			return false
+		}
+		delete(s.retries, m.ClientID)
+		return true
+	})
+}
+
+// abandon drops the resume request sent as clientID after the server
+// refused it. A room that could not be rejoined is forgotten, so that
+// messages to it are not sent in vain.
+func (s *session) abandon(clientID string) {
+	i := slices.IndexFunc(s.requests, func(m Message) bool { return m.ClientID == clientID })
+	if i < 0 {
+		return
+	}
+	var c struct {
+		Room string `json:"room"`
+	}
+	if m := s.requests[i]; json.Unmarshal(m.Content, &c) == nil {
+		if m.Type == TypeJoin {
+			delete(s.rooms, c.Room)
+		}
+		delete(s.replays, c.Room)
+	}
+	s.requests = slices.Delete(s.requests, i, i+1)
+	delete(s.retries, clientID)
+}
+
+// outstanding returns the pending message or resume request sent as
+// clientID. The caller must hold mu.
+func (s *session) outstanding(clientID string) (Message, bool) {
+	for _, list := range [][]Message{s.pending, s.requests} {
+		if i := slices.IndexFunc(list, func(m Message) bool { return m.ClientID == clientID }); i >= 0 {
+			return list[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// retryLater resends the pending message or resume request sent as
+// clientID after a backoff. The caller must hold mu.
+func (s *session) retryLater(clientID string) {
+	if _, ok := s.outstanding(clientID); !ok {
+		return
+	}
+	backoff := min(retryMin<<min(s.retries[clientID], 5), retryMax)
+	s.retries[clientID]++
+
+	time.AfterFunc(backoff, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// While disconnected, the next reconnect resends it anyway.
+		if m, ok := s.outstanding(clientID); ok && s.encoder != nil {
+			s.encoder.Encode(m)
+		}
+	})
+}
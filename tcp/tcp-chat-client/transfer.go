@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Files are sent in chunks of fileChunkSize bytes, with at most
+// fileWindow chunks awaiting the recipient's acknowledgement, so chat
+// messages are never stuck behind a whole file.
+const (
+	fileChunkSize = 16 << 10
+	fileWindow    = 8
+)
+
+// outgoingFile is a file offered to another user. Once accepted, a
+// goroutine sends its chunks, taking a slot in window for each and
+// waiting for file_ack to release it.
+type outgoingFile struct {
+	id, to, path string
+	size         int64
+	window       chan struct{}
+	done         chan struct{} // closed when the transfer ends
+	progress     progress
+}
+
+// incomingFile is a file offered by another user. Accepted data is
+// written to a .part file that is renamed once the checksum matches.
+type incomingFile struct {
+	id, from, name string
+	size           int64
+	sum            string
+
+	accepted bool
+	file     *os.File
+	hash     hash.Hash
+	nextSeq  uint64
+	received int64
+	progress progress
+}
+
+// fileTransfers tracks the file transfers of a session. Transfers do
+// not survive a reconnect; the server cancels them when the connection
+// drops.
+type fileTransfers struct {
+	dir  string
+	send func(Message)
+
+	mu       sync.Mutex
+	outgoing map[string]*outgoingFile
+	incoming map[string]*incomingFile
+}
+
+func newFileTransfers(dir string, send func(Message)) *fileTransfers {
+	return &fileTransfers{
+		dir:      dir,
+		send:     send,
+		outgoing: make(map[string]*outgoingFile),
+		incoming: make(map[string]*incomingFile),
+	}
+}
+
+// offer prepares path for sending to nick and returns the offer.
+func (ft *fileTransfers) offer(nick, path string) (Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Message{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return Message{}, err
+	}
+	if size == 0 {
+		return Message{}, errors.New("cannot send an empty file")
+	}
+
+	var id [4]byte
+	rand.Read(id[:])
+	out := &outgoingFile{
+		id:       hex.EncodeToString(id[:]),
+		to:       nick,
+		path:     path,
+		size:     size,
+		window:   make(chan struct{}, fileWindow),
+		done:     make(chan struct{}),
+		progress: progress{total: size},
+	}
+
+	ft.mu.Lock()
+	ft.outgoing[out.id] = out
+	ft.mu.Unlock()
+
+	fmt.Printf("Offering %s (%s) to %s as transfer %s\n", filepath.Base(path), formatSize(size), nick, out.id)
+	return newMessage(TypeFileOffer, FileOfferContent{
+		ID:     out.id,
+		To:     nick,
+		Name:   filepath.Base(path),
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}), nil
+}
+
+// accept starts receiving transfer id into the download directory.
+func (ft *fileTransfers) accept(id string) (Message, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	in, ok := ft.incoming[id]
+	if !ok || in.accepted {
+		return Message{}, fmt.Errorf("no pending file offer %s", id)
+	}
+	f, err := os.CreateTemp(ft.dir, in.name+".*.part")
+	if err != nil {
+		return Message{}, err
+	}
+	in.accepted = true
+	in.file = f
+	in.hash = sha256.New()
+	return newMessage(TypeFileAccept, FileAcceptContent{ID: id}), nil
+}
+
+// cancel aborts or declines transfer id.
+func (ft *fileTransfers) cancel(id string) (Message, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if !ft.end(id) {
+		return Message{}, fmt.Errorf("no file transfer %s", id)
+	}
+	return newMessage(TypeFileCancel, FileCancelContent{ID: id, Reason: "cancelled by user"}), nil
+}
+
+// end forgets transfer id, stopping its sender and removing partial
+// data. The caller must hold mu.
+func (ft *fileTransfers) end(id string) bool {
+	if out, ok := ft.outgoing[id]; ok {
+		close(out.done)
+		delete(ft.outgoing, id)
+		return true
+	}
+	if in, ok := ft.incoming[id]; ok {
+		if in.file != nil {
+			in.file.Close()
+			os.Remove(in.file.Name())
+		}
+		delete(ft.incoming, id)
+		return true
+	}
+	return false
+}
+
+// abortAll ends every transfer after the connection is lost.
+func (ft *fileTransfers) abortAll() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	for id := range ft.outgoing {
+		fmt.Printf("Transfer %s aborted\n", id)
+		ft.end(id)
+	}
+	for id := range ft.incoming {
+		fmt.Printf("Transfer %s aborted\n", id)
+		ft.end(id)
+	}
+}
+
+// handle processes a file transfer message from the server and returns
+// the line to display, if any. A reply to the server is sent only once
+// mu is released, since sending waits on the connection.
+func (ft *fileTransfers) handle(msg Message) (string, error) {
+	ft.mu.Lock()
+	line, reply, err := ft.update(msg)
+	ft.mu.Unlock()
+
+	if reply != nil {
+		ft.send(*reply)
+	}
+	return line, err
+}
+
+// update applies msg to the transfers and returns the line to display
+// and the reply to send, if any. The caller must hold mu.
+func (ft *fileTransfers) update(msg Message) (string, *Message, error) {
+	switch msg.Type {
+	case TypeFileOffer:
+		var c FileOfferContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", nil, err
+		}
+		name := filepath.Base(c.Name)
+		if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return "", nil, fmt.Errorf("unsafe file name %q", c.Name)
+		}
+		ft.incoming[c.ID] = &incomingFile{
+			id:       c.ID,
+			from:     c.From,
+			name:     name,
+			size:     c.Size,
+			sum:      c.SHA256,
+			progress: progress{total: c.Size},
+		}
+		return fmt.Sprintf("*** %s offers %s (%s). /accept %s or /decline %s",
+			sender(c.From, msg.From), name, formatSize(c.Size), c.ID, c.ID), nil, nil
+
+	case TypeFileAccept:
+		var c FileAcceptContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", nil, err
+		}
+		out, ok := ft.outgoing[c.ID]
+		if !ok {
+			return "", nil, nil
+		}
+		go ft.sendChunks(out)
+		return fmt.Sprintf("*** %s accepted %s, sending", out.to, filepath.Base(out.path)), nil, nil
+
+	case TypeFileAck:
+		var c FileAckContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", nil, err
+		}
+		out, ok := ft.outgoing[c.ID]
+		if !ok {
+			return "", nil, nil
+		}
+		select {
+		case <-out.window:
+		default:
+		}
+		return "", nil, nil
+
+	case TypeFileChunk:
+		var c FileChunkContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", nil, err
+		}
+		in, ok := ft.incoming[c.ID]
+		if !ok || !in.accepted {
+			return "", nil, nil
+		}
+		if err := in.write(c); err != nil {
+			ft.end(c.ID)
+			cancel := newMessage(TypeFileCancel, FileCancelContent{ID: c.ID, Reason: err.Error()})
+			return fmt.Sprintf("*** Receiving %s failed: %v", in.name, err), &cancel, nil
+		}
+		ack := newMessage(TypeFileAck, FileAckContent{ID: c.ID, Seq: c.Seq})
+		if pct, ok := in.progress.advance(int64(len(c.Data))); ok {
+			return fmt.Sprintf("*** Receiving %s: %d%%", in.name, pct), &ack, nil
+		}
+		return "", &ack, nil
+
+	case TypeFileDone:
+		var c FileDoneContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", nil, err
+		}
+		in, ok := ft.incoming[c.ID]
+		if !ok || !in.accepted {
+			return "", nil, nil
+		}
+		path, err := in.finish(ft.dir)
+		delete(ft.incoming, c.ID)
+		if err != nil {
+			os.Remove(in.file.Name())
+			return fmt.Sprintf("*** Receiving %s failed: %v", in.name, err), nil, nil
+		}
+		return fmt.Sprintf("*** Saved %s from %s to %s", in.name, in.from, path), nil, nil
+
+	case TypeFileCancel:
+		var c FileCancelContent
+		if err := json.Unmarshal(msg.Content, &c); err != nil {
+			return "", nil, err
+		}
+		if !ft.end(c.ID) {
+			return "", nil, nil
+		}
+		return fmt.Sprintf("*** Transfer %s cancelled: %s", c.ID, c.Reason), nil, nil
+	}
+	return "", nil, nil
+}
+
+// sendChunks streams out to the server, keeping at most fileWindow
+// chunks unacknowledged.
+func (ft *fileTransfers) sendChunks(out *outgoingFile) {
+	fail := func(err error) {
+		ft.mu.Lock()
+		ended := ft.end(out.id)
+		ft.mu.Unlock()
+		if ended {
+			ft.send(newMessage(TypeFileCancel, FileCancelContent{ID: out.id, Reason: err.Error()}))
+			fmt.Printf("\nSending %s failed: %v\n", filepath.Base(out.path), err)
+		}
+	}
+
+	f, err := os.Open(out.path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer f.Close()
+
+	buf := make([]byte, fileChunkSize)
+	var sent int64
+	for seq := uint64(0); sent < out.size; seq++ {
+		select {
+		case out.window <- struct{}{}:
+		case <-out.done:
+			return
+		}
+
+		n, err := io.ReadFull(f, buf[:min(int64(len(buf)), out.size-sent)])
+		if err != nil {
+			fail(fmt.Errorf("file changed while sending: %w", err))
+			return
+		}
+		sent += int64(n)
+		ft.send(newMessage(TypeFileChunk, FileChunkContent{ID: out.id, Seq: seq, Data: buf[:n]}))
+		if pct, ok := out.progress.advance(int64(n)); ok {
+			fmt.Printf("\nSending %s: %d%%\n", filepath.Base(out.path), pct)
+		}
+	}
+
+	// Wait for every chunk to be acknowledged, so that no file_ack is
+	// still on its way when the server closes the transfer.
+	for range fileWindow {
+		select {
+		case out.window <- struct{}{}:
+		case <-out.done:
+			return
+		}
+	}
+
+	ft.mu.Lock()
+	_, active := ft.outgoing[out.id]
+	delete(ft.outgoing, out.id)
+	ft.mu.Unlock()
+	if active {
+		ft.send(newMessage(TypeFileDone, FileDoneContent{ID: out.id}))
+	}
+}
+
+func (in *incomingFile) write(c FileChunkContent) error {
+	if c.Seq != in.nextSeq {
+		return fmt.Errorf("expected chunk %d, got %d", in.nextSeq, c.Seq)
+	}
+	if in.received+int64(len(c.Data)) > in.size {
+		return errors.New("more data than offered")
+	}
+	if _, err := in.file.Write(c.Data); err != nil {
+		return err
+	}
+	in.hash.Write(c.Data)
+	in.nextSeq++
+	in.received += int64(len(c.Data))
+	return nil
+}
+
+// finish verifies the received data and moves it to a free name in dir.
+func (in *incomingFile) finish(dir string) (string, error) {
+	if err := in.file.Close(); err != nil {
+		return "", err
+	}
+	if in.received != in.size {
+		return "", fmt.Errorf("received %d of %d bytes", in.received, in.size)
+	}
+	if got := hex.EncodeToString(in.hash.Sum(nil)); !strings.EqualFold(got, in.sum) {
+		return "", errors.New("SHA-256 checksum mismatch")
+	}
+
+	ext := filepath.Ext(in.name)
+	base := strings.TrimSuffix(in.name, ext)
+	path := filepath.Join(dir, in.name)
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+	}
+	if err := os.Rename(in.file.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// progress reports completion in steps of ten percent.
+type progress struct {
+	total, done int64
+	shown       int
+}
+
+func (p *progress) advance(n int64) (int, bool) {
+	p.done += n
+	pct := int(p.done * 100 / p.total)
+	if pct/10 == p.shown/10 {
+		return pct, false
+	}
+	p.shown = pct
+	return pct, true
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authFailureDelay slows down password guessing on a single connection.
+const authFailureDelay = time.Second
+
+// dummyHash is compared against when the username is unknown so that
+// failures take the same time whether or not the user exists. It is
+// made on the first such failure rather than at startup, which servers
+// without password logins would pay for nothing.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	return hash
+})
+
+type authOptions struct {
+	credentialsFile string
+	tokenSecretFile string
+}
+
+// authenticator verifies the auth message every client must send first,
+// using bcrypt hashes from a credentials file or HMAC-signed tokens.
+type authenticator struct {
+	users  map[string][]byte
+	secret []byte
+}
+
+func newAuthenticator(opts authOptions) (*authenticator, error) {
+	a := &authenticator{}
+
+	if opts.credentialsFile != "" {
+		users, err := loadCredentials(opts.credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+
+	secret, err := loadTokenSecret(opts.tokenSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	a.secret = secret
+
+	if a.users == nil && a.secret == nil {
+		return nil, errors.New("authentication requires -credentials or a token secret")
+	}
+	return a, nil
+}
+
+// loadCredentials reads "username:bcrypt-hash" lines. Blank lines and
+// lines starting with # are ignored.
+func loadCredentials(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open credentials file: %w", err)
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || validateNick(user) != nil {
+			return nil, fmt.Errorf("%s:%d: expected username:bcrypt-hash", path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid bcrypt hash: %w", path, n, err)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read credentials file: %w", err)
+	}
+	return users, nil
+}
+
+// loadTokenSecret reads the HMAC secret from path, falling back to the
+// CHAT_TOKEN_SECRET environment variable. It returns nil if neither is
+// set.
+func loadTokenSecret(path string) ([]byte, error) {
+	secret := os.Getenv("CHAT_TOKEN_SECRET")
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read token secret: %w", err)
+		}
+		secret = string(b)
+	}
+
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return nil, nil
+	}
+	if len(secret) < 16 {
+		return nil, errors.New("token secret must be at least 16 bytes")
+	}
+	return []byte(secret), nil
+}
+
+// authenticate returns the identity proven by content.
+func (a *authenticator) authenticate(content AuthContent) (string, *protocolError) {
+	switch {
+	case content.Token != "" && (content.Username != "" || content.Password != ""):
+		return "", errorf(ErrBadRequest, "send either a token or a username and password")
+	case content.Token != "":
+		if a.secret == nil {
+			return "", errorf(ErrAuthFailed, "token authentication is not enabled")
+		}
+		user, err := verifyToken(a.secret, content.Token, time.Now())
+		if err != nil {
+			return "", errorf(ErrAuthFailed, "invalid token: %v", err)
+		}
+		return user, nil
+	case content.Username != "":
+		if a.users == nil {
+			return "", errorf(ErrAuthFailed, "password authentication is not enabled")
+		}
+		hash, ok := a.users[content.Username]
+		if !ok {
+			hash = dummyHash()
+		}
+		if bcrypt.CompareHashAndPassword(hash, []byte(content.Password)) != nil || !ok {
+			return "", errorf(ErrAuthFailed, "invalid username or password")
+		}
+		return content.Username, nil
+	default:
+		return "", errorf(ErrBadRequest, "auth requires a token or a username and password")
+	}
+}
+
+// login reads the first message from a new connection and checks that
+// it is a valid auth message. On failure the client has been sent an
+// error and should be disconnected.
+func (s *Server) login(c *client, decoder *json.Decoder) (string, bool) {
+	clientAddr := c.conn.RemoteAddr().String()
+
+	c.conn.SetReadDeadline(time.Now().Add(s.opts.authTimeout))
+	var msg Message
+	if err := decoder.Decode(&msg); err != nil {
+		log.Printf("Client %s did not authenticate: %v\n", clientAddr, err)
+		c.send(errorMessage(errorf(ErrAuthRequired, "authentication timed out or failed to parse")))
+		return "", false
+	}
+	c.conn.SetReadDeadline(time.Time{})
+
+	if msg.Type != TypeAuth {
+		c.send(errorMessage(errorf(ErrAuthRequired, "the first message must be auth")))
+		return "", false
+	}
+
+	var content AuthContent
+	if perr := decodeContent(msg, &content); perr != nil {
+		c.send(errorMessage(perr))
+		return "", false
+	}
+
+	user, perr := s.auth.authenticate(content)
+	if perr != nil {
+		log.Printf("Failed login from %s: %s\n", clientAddr, perr.message)
+		time.Sleep(authFailureDelay)
+		c.send(errorMessage(perr))
+		return "", false
+	}
+
+	// Address bans are checked only now, and not for operators, so that
+	// an admin behind a banned address can still get in to lift it.
+	var conn net.Conn
+	if s.mod.roleOf(user) == roleUser {
+		conn = c.conn
+	}
+	if perr := s.checkBanned(user, conn); perr != nil {
+		log.Printf("Rejected banned user %s from %s\n", user, clientAddr)
+		c.send(errorMessage(perr))
+		return "", false
+	}
+
+	c.send(newMessage(TypeAuth, AuthContent{Username: user}))
+	return user, true
+}
+
+// printPasswordHash reads a password from stdin and prints a line for
+// the credentials file.
+func printPasswordHash() error {
+	reader := bufio.NewReader(os.Stdin)
+	password, err := reader.ReadString('\n')
+	if err != nil && password == "" {
+		return fmt.Errorf("could not read password: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+func printToken(secretFile, user string, ttl time.Duration) error {
+	if err := validateNick(user); err != nil {
+		return err
+	}
+	secret, err := loadTokenSecret(secretFile)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return errors.New("no token secret configured")
+	}
+
+	fmt.Println(issueToken(secret, user, time.Now().Add(ttl)))
+	return nil
+}
+
+// Tokens have the form user.expiry.signature, where expiry is a Unix
+// timestamp and signature is the base64url HMAC-SHA256 of "user.expiry".
+func issueToken(secret []byte, user string, expiry time.Time) string {
+	payload := user + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + signToken(secret, payload)
+}
+
+func verifyToken(secret []byte, token string, now time.Time) (string, error) {
+	user, rest, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errors.New("malformed token")
+	}
+	expiry, sig, ok := strings.Cut(rest, ".")
+	if !ok {
+		return "", errors.New("malformed token")
+	}
+
+	want := signToken(secret, user+"."+expiry)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return "", errors.New("bad signature")
+	}
+
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", errors.New("malformed expiry")
+	}
+	if now.After(time.Unix(exp, 0)) {
+		return "", errors.New("token expired")
+	}
+	if validateNick(user) != nil {
+		return "", errors.New("invalid username")
+	}
+	return user, nil
+}
+
+func signToken(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Slow-consumer policies applied when a client's send queue is full.
+const (
+	policyDropOldest = "drop-oldest"
+	policyDisconnect = "disconnect"
+)
+
+func validatePolicy(policy string) error {
+	switch policy {
+	case policyDropOldest, policyDisconnect:
+		return nil
+	default:
+		return fmt.Errorf("unknown slow-consumer policy %q (want %s or %s)", policy, policyDropOldest, policyDisconnect)
+	}
+}
+
+type client struct {
+	conn  net.Conn
+	user  string           // authenticated identity, set once at login
+	nick  string           // guarded by Server.clientsMux
+	rooms map[string]*room // guarded by Server.clientsMux
+
+	// queue holds outbound messages for writeLoop. send never blocks:
+	// when the queue is full the server's slow-consumer policy applies.
+	queueMux sync.Mutex
+	queue    chan Message
+	done     chan struct{}
+	policy   string
+	dropped  atomic.Uint64
+	slow     atomic.Bool
+	stats    *sendStats
+}
+
+// sendStats counts messages that could not be queued, across clients.
+type sendStats struct {
+	dropped         atomic.Uint64
+	slowDisconnects atomic.Uint64
+}
+
+func newClient(conn net.Conn, opts serverOptions, stats *sendStats) *client {
+	return &client{
+		conn:   conn,
+		rooms:  make(map[string]*room),
+		queue:  make(chan Message, opts.sendQueue),
+		done:   make(chan struct{}),
+		policy: opts.slowPolicy,
+		stats:  stats,
+	}
+}
+
+// send queues msg for delivery without blocking the caller.
+func (c *client) send(msg Message) {
+	c.queueMux.Lock()
+	defer c.queueMux.Unlock()
+
+	select {
+	case c.queue <- msg:
+		return
+	default:
+	}
+
+	if c.policy == policyDisconnect {
+		if c.slow.CompareAndSwap(false, true) {
+			c.stats.slowDisconnects.Add(1)
+			abort(c.conn)
+		}
+		c.drop()
+		return
+	}
+
+	// Make room by discarding the oldest queued message. The writer may
+	// have drained the queue in the meantime, so neither step blocks.
+	select {
+	case <-c.queue:
+		c.drop()
+	default:
+	}
+	select {
+	case c.queue <- msg:
+	default:
+		c.drop()
+	}
+}
+
+// stamp marks msg as originating from the authenticated user of c and
+// records when the server accepted it.
+func (c *client) stamp(msg Message) Message {
+	now := time.Now().UTC()
+	msg.From = c.user
+	msg.Time = &now
+	return msg
+}
+
+// disconnect ends the read loop of c. Unlike closing the connection, it
+// lets writeLoop flush messages already queued, such as the reason.
+func (c *client) disconnect() {
+	c.conn.SetReadDeadline(time.Now())
+}
+
+func (c *client) drop() {
+	c.dropped.Add(1)
+	c.stats.dropped.Add(1)
+}
+
+// writeLoop encodes queued messages to the connection until done is
+// closed, then flushes what is left. A failed or timed out write closes
+// the connection, which ends the read loop.
+func (c *client) writeLoop(timeout time.Duration) {
+	encoder := json.NewEncoder(c.conn)
+	write := func(msg Message) bool {
+		if err := c.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return false
+		}
+		if err := encoder.Encode(msg); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error writing to %s: %v\n", c.conn.RemoteAddr(), err)
+			}
+			c.conn.Close()
+			return false
+		}
+		return true
+	}
+
+	for {
+		select {
+		case msg := <-c.queue:
+			if !write(msg) {
+				return
+			}
+		case <-c.done:
+			for {
+				select {
+				case msg := <-c.queue:
+					if !write(msg) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Client IDs are remembered per user for dedupeWindow, up to
+// dedupeMaxPerUser of the most recent ones, so a message retransmitted
+// after a reconnect is acknowledged again instead of delivered twice.
+const (
+	dedupeWindow     = 10 * time.Minute
+	dedupeMaxPerUser = 1024
+	maxClientIDLen   = 64
+)
+
+type dedupeEntry struct {
+	clientID string
+	id       uint64
+	seen     time.Time
+	// done is closed once a reserved entry is settled or released, and
+	// nil afterwards.
+	done chan struct{}
+}
+
+type dedupeCache struct {
+	mu    sync.Mutex
+	users map[string][]dedupeEntry // oldest first
+}
+
+func newDedupeCache() *dedupeCache {
+	return &dedupeCache{users: make(map[string][]dedupeEntry)}
+}
+
+// claim returns the message ID already assigned to clientID from user,
+// or reserves clientID so that a copy arriving on another connection
+// waits for this delivery instead of being published as well. The
+// caller must then settle or release the reservation.
+func (d *dedupeCache) claim(user, clientID string) (uint64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for {
+		d.expire(user)
+		i := d.find(user, clientID)
+		if i < 0 {
+			break
+		}
+		e := d.users[user][i]
+		if e.done == nil {
+			return e.id, true
+		}
+		d.mu.Unlock()
+		<-e.done
+		d.mu.Lock()
+	}
+
+	entries := append(d.users[user], dedupeEntry{clientID: clientID, seen: time.Now(), done: make(chan struct{})})
+	if len(entries) > dedupeMaxPerUser {
+		// Reservations dropped here let their waiters claim again.
+		for _, e := range entries[:len(entries)-dedupeMaxPerUser] {
+			if e.done != nil {
+				close(e.done)
+			}
+		}
+		entries = entries[len(entries)-dedupeMaxPerUser:]
+	}
+	d.users[user] = entries
+	return 0, false
+}
+
+// settle records that the message reserved as clientID was delivered
+// under id.
+func (d *dedupeCache) settle(user, clientID string, id uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if i := d.find(user, clientID); i >= 0 {
+		e := &d.users[user][i]
+		if e.done != nil {
+			e.id = id
+			e.seen = time.Now()
+			close(e.done)
+			e.done = nil
+		}
+	}
+}
+
+// release drops the reservation of clientID if it was not settled, so
+// that a retransmission is delivered.
+func (d *dedupeCache) release(user, clientID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := d.find(user, clientID)
+	if i < 0 || d.users[user][i].done == nil {
+		return
+	}
+	close(d.users[user][i].done)
+	d.users[user] = slices.Delete(d.users[user], i, i+1)
+	if len(d.users[user]) == 0 {
+		delete(d.users, user)
+	}
+}
+
+// find returns the index of clientID among the entries of user, or -1.
+// The caller must hold mu.
+func (d *dedupeCache) find(user, clientID string) int {
+	return slices.IndexFunc(d.users[user], func(e dedupeEntry) bool {
+		return e.clientID == clientID
+	})
+}
+
+// expire drops settled entries older than dedupeWindow. The caller
+// must hold mu.
+func (d *dedupeCache) expire(user string) {
+	entries := d.users[user]
+	i := 0
+	for i < len(entries) && entries[i].done == nil && time.Since(entries[i].seen) > dedupeWindow {
+		i++
+	}
+	if i == len(entries) {
+		delete(d.users, user)
+		return
+	}
+	d.users[user] = entries[i:]
+}
+
+// publish assigns the next message ID to msg, stores it in the history
+// log under room and hands it to deliver. Holding seqMux across all three
+// steps means every recipient sees messages in ID order. Direct messages,
+// published under no room, are stored only with storeDMs.
+func (s *Server) publish(room string, msg Message, deliver func(Message)) (Message, *protocolError) {
+	s.seqMux.Lock()
+	defer s.seqMux.Unlock()
+
+	switch {
+	case s.history != nil && (room != "" || s.opts.storeDMs):
+		var err error
+		if msg, err = s.history.append(room, msg); err != nil {
+			log.Printf("Error storing message: %v\n", err)
+			return msg, errorf(ErrUnavailable, "could not store message, try again")
+		}
+	case s.history != nil:
+		msg.ID = s.history.skip()
+	default:
+		msg.ID = s.nextID
+		s.nextID++
+	}
+
+	deliver(msg)
+	return msg, nil
+}
+
+// ack confirms to c that the message it sent as clientID was accepted
+// under id.
+func (s *Server) ack(c *client, clientID string, id uint64, duplicate bool) {
+	if clientID == "" {
+		return
+	}
+	if !duplicate {
+		s.dedupe.settle(c.user, clientID, id)
+	}
+	c.send(newMessage(TypeAck, AckContent{ClientID: clientID, ID: id, Duplicate: duplicate}))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var errMessageTooLarge = errors.New("message too large")
+
+// Joins and history requests draw on a bucket of their own with at
+// least requestBurst tokens, since a reconnecting client sends one of
+// each for every room it was in at once.
+const requestBurst = 64
+
+// sizeLimiter caps how far the JSON decoder may read past the start of
+// the message it is decoding. After each message, next moves the limit
+// to maxSize bytes beyond the end of that message, so a single message
+// larger than maxSize fails with errMessageTooLarge before it is
+// buffered in full.
+type sizeLimiter struct {
+	r       io.Reader
+	maxSize int64
+	read    int64
+	limit   int64
+}
+
+func newSizeLimiter(r io.Reader, maxSize int64) *sizeLimiter {
+	return &sizeLimiter{r: r, maxSize: maxSize, limit: maxSize}
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	if l.read >= l.limit {
+		return 0, errMessageTooLarge
+	}
+	if remaining := l.limit - l.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+// next starts the budget for the message following offset, the
+// decoder's InputOffset after the last message.
+func (l *sizeLimiter) next(offset int64) {
+	l.limit = offset + l.maxSize
+}
+
+// rateLimiter is a token bucket allowing rate messages per second with
+// bursts of up to burst. Messages beyond that are rejected, and after
+// maxStrikes rejections without the bucket refilling completely in
+// between, the client should be disconnected.
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	maxStrikes int
+
+	tokens  float64
+	last    time.Time
+	strikes int
+}
+
+func newRateLimiter(rate float64, burst, maxStrikes int) *rateLimiter {
+	return &rateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		maxStrikes: maxStrikes,
+		tokens:     float64(burst),
+		last:       time.Now(),
+	}
+}
+
+// allow reports whether a message arriving at now is within the limit,
+// and if not, whether the client has exhausted its warnings.
+func (r *rateLimiter) allow(now time.Time) (ok, disconnect bool) {
+	r.tokens = min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+	if r.tokens == r.burst {
+		r.strikes = 0
+	}
+
+	if r.tokens >= 1 {
+		r.tokens--
+		return true, false
+	}
+	r.strikes++
+	return false, r.strikes > r.maxStrikes
+}
+
+// acquireConn counts a connection from ip against the per-address
+// limit and reports whether it may proceed. Every successful call must
+// be paired with releaseConn.
+func (s *Server) acquireConn(ip string) bool {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+
+	if s.opts.maxConnsPerIP > 0 && s.connsPerIP[ip] >= s.opts.maxConnsPerIP {
+		return false
+	}
+	s.connsPerIP[ip]++
+	return true
+}
+
+func (s *Server) releaseConn(ip string) {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+
+	if s.connsPerIP[ip]--; s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
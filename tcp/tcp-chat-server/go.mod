@@ -1,3 +1,8 @@
 module tidy
 
 go 1.23.1
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.30.0
+)
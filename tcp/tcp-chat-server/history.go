@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// History requests without a count return defaultHistory messages, or
+// maxHistory when paging forward from an ID, and none return more than
+// maxHistory.
+const (
+	defaultHistory = 50
+	maxHistory     = 500
+)
+
+type historyOptions struct {
+	dir         string
+	segmentSize int64         // rotate the active segment beyond this size
+	maxSegments int           // keep at most this many segments, 0 for no limit
+	retention   time.Duration // drop segments last written before this, 0 to keep
+}
+
+// historyRecord is one line of a segment file.
+type historyRecord struct {
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room"`
+	Message Message   `json:"message"`
+}
+
+type segment struct {
+	firstID uint64
+	path    string
+	size    int64
+	modTime time.Time
+	rooms   map[string]int // messages per room, so queries skip segments
+}
+
+// historyLog is an append-only message log split into segment files
+// named after the first message ID they contain. Old segments are
+// removed according to the retention options.
+type historyLog struct {
+	mu       sync.Mutex
+	opts     historyOptions
+	segments []*segment // oldest first; the last one is active
+	active   *os.File
+	nextID   uint64
+}
+
+func openHistory(opts historyOptions) (*historyLog, error) {
+	if err := os.MkdirAll(opts.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create history directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(opts.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read history directory: %w", err)
+	}
+
+	h := &historyLog{opts: opts, nextID: 1}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		firstID, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		h.segments = append(h.segments, &segment{
+			firstID: firstID,
+			path:    filepath.Join(opts.dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			rooms:   make(map[string]int),
+		})
+	}
+	sort.Slice(h.segments, func(i, j int) bool { return h.segments[i].firstID < h.segments[j].firstID })
+
+	// The active segment is indexed while it is recovered.
+	for _, seg := range h.segments[:max(len(h.segments)-1, 0)] {
+		err := scanSegment(seg.path, seg.size, func(rec historyRecord) bool {
+			seg.rooms[rec.Room]++
+			return true
+		})
+		if err != nil {
+			log.Printf("Error indexing history segment %s: %v\n", seg.path, err)
+		}
+	}
+
+	if len(h.segments) == 0 {
+		if err := h.rotate(); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+
+	last := h.segments[len(h.segments)-1]
+	lastID, err := recoverSegment(last)
+	if err != nil {
+		return nil, err
+	}
+	h.nextID = max(lastID+1, last.firstID)
+
+	h.active, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open history segment: %w", err)
+	}
+	h.expire()
+
+	log.Printf("History loaded from %s: %d segments, next message ID %d\n", opts.dir, len(h.segments), h.nextID)
+	return h, nil
+}
+
+// recoverSegment returns the last message ID in seg, truncating a
+// partially written record left behind by a crash.
+func recoverSegment(seg *segment) (uint64, error) {
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("could not open history segment: %w", err)
+	}
+	defer f.Close()
+
+	var lastID uint64
+	var valid int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var rec historyRecord
+		if json.Unmarshal(line, &rec) != nil {
+			break
+		}
+		lastID = rec.ID
+		valid += int64(len(line))
+		seg.rooms[rec.Room]++
+	}
+
+	if valid < seg.size {
+		log.Printf("Truncating %d bytes of incomplete history in %s\n", seg.size-valid, seg.path)
+		if err := f.Truncate(valid); err != nil {
+			return 0, err
+		}
+		seg.size = valid
+	}
+	return lastID, nil
+}
+
+// append stores msg for room, assigning and returning its message ID.
+func (h *historyLog) append(room string, msg Message) (Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	msg.ID = h.nextID
+	line, err := json.Marshal(historyRecord{ID: msg.ID, Time: time.Now(), Room: room, Message: msg})
+	if err != nil {
+		return msg, err
+	}
+	line = append(line, '\n')
+
+	active := h.segments[len(h.segments)-1]
+	if active.size > 0 && active.size+int64(len(line)) > h.opts.segmentSize {
+		if err := h.rotate(); err != nil {
+			return msg, err
+		}
+		active = h.segments[len(h.segments)-1]
+	}
+
+	if _, err := h.active.Write(line); err != nil {
+		return msg, fmt.Errorf("could not write history: %w", err)
+	}
+	active.size += int64(len(line))
+	active.modTime = time.Now()
+	active.rooms[room]++
+	h.nextID++
+	return msg, nil
+}
+
+// skip assigns a message ID without storing anything, for messages
+// that are kept out of the log.
+func (h *historyLog) skip() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := h.nextID
+	h.nextID++
+	return id
+}
+
+// rotate closes the active segment and starts a new one at nextID. The
+// caller must hold mu, except while opening the log.
+func (h *historyLog) rotate() error {
+	if h.active != nil {
+		if err := h.active.Sync(); err != nil {
+			log.Printf("Error syncing history segment: %v\n", err)
+		}
+		h.active.Close()
+	}
+
+	path := filepath.Join(h.opts.dir, fmt.Sprintf("%020d.log", h.nextID))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not create history segment: %w", err)
+	}
+
+	h.active = f
+	h.segments = append(h.segments, &segment{firstID: h.nextID, path: path, modTime: time.Now(), rooms: make(map[string]int)})
+	h.expire()
+	return nil
+}
+
+// expire removes the oldest segments beyond the retention limits. The
+// active segment is always kept.
+func (h *historyLog) expire() {
+	for len(h.segments) > 1 {
+		oldest := h.segments[0]
+		tooMany := h.opts.maxSegments > 0 && len(h.segments) > h.opts.maxSegments
+		tooOld := h.opts.retention > 0 && time.Since(oldest.modTime) > h.opts.retention
+		if !tooMany && !tooOld {
+			return
+		}
+
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing history segment %s: %v\n", oldest.path, err)
+			return
+		}
+		log.Printf("Removed history segment %s\n", oldest.path)
+		h.segments = h.segments[1:]
+	}
+}
+
+// segmentView is the part of a segment a query reads: its file up to
+// the size it had when the query started.
+type segmentView struct {
+	path string
+	size int64
+}
+
+// query returns messages for room, oldest first. With since set it
+// returns up to limit messages with a larger ID, otherwise the last
+// limit messages.
+//
+// Only the choice of segments happens under mu; append, and with it
+// message delivery, never waits for the files to be read. Segments
+// without messages for room are skipped, and a request for the last
+// messages reads back from the newest segment only as far as needed.
+func (h *historyLog) query(room string, since uint64, limit int) ([]Message, error) {
+	h.mu.Lock()
+	h.expire()
+	var views []segmentView
+	if since > 0 {
+		for i, seg := range h.segments {
+			if i+1 < len(h.segments) && h.segments[i+1].firstID <= since+1 {
+				continue
+			}
+			if seg.rooms[room] > 0 {
+				views = append(views, segmentView{seg.path, seg.size})
+			}
+		}
+	} else {
+		found := 0
+		for i := len(h.segments) - 1; i >= 0 && found < limit; i-- {
+			seg := h.segments[i]
+			if n := seg.rooms[room]; n > 0 {
+				views = append(views, segmentView{seg.path, seg.size})
+				found += n
+			}
+		}
+		slices.Reverse(views)
+	}
+	h.mu.Unlock()
+
+	var msgs []Message
+	for _, view := range views {
+		err := scanSegment(view.path, view.size, func(rec historyRecord) bool {
+			if rec.Room != room || rec.ID <= since {
+				return true
+			}
+			msgs = append(msgs, rec.Message)
+			if since > 0 {
+				return len(msgs) < limit
+			}
+			if len(msgs) > limit {
+				msgs = msgs[1:]
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if since > 0 && len(msgs) >= limit {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+// scanSegment calls fn for every record in the first size bytes of the
+// file at path until fn returns false.
+func scanSegment(path string, size int64, fn func(historyRecord) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(io.LimitReader(f, size))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec historyRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("corrupt record in %s: %w", path, err)
+		}
+		if !fn(rec) {
+			return nil
+		}
+	}
+}
+
+func (h *historyLog) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.active.Sync(); err != nil {
+		return err
+	}
+	return h.active.Close()
+}
@@ -2,95 +2,641 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 )
 
-type Message struct {
-	Type    string      `json:"type"`
-	Content interface{} `json:"content"`
+type serverOptions struct {
+	sendQueue      int
+	slowPolicy     string
+	writeTimeout   time.Duration
+	authTimeout    time.Duration
+	maxMessageSize int64
+	rateLimit      float64 // messages per second, 0 for no limit
+	rateBurst      int
+	floodStrikes   int
+	maxConnsPerIP  int // 0 for no limit
+	maxFileSize    int64
+	storeDMs       bool // keep direct messages in the history log
 }
 
 type Server struct {
-	clients    map[net.Conn]bool
+	opts  serverOptions
+	stats sendStats
+
+	clients    map[*client]bool
+	nicks      map[string]*client
+	rooms      map[string]*room
 	clientsMux sync.RWMutex
+
+	connsPerIP map[string]int
+	connsMux   sync.Mutex
+
+	auth      *authenticator
+	dedupe    *dedupeCache
+	mod       *moderation
+	transfers *transfers
+
+	// seqMux orders ID assignment and delivery; nextID is only used
+	// when history is disabled, otherwise the history log assigns IDs.
+	seqMux sync.Mutex
+	nextID uint64
+
+	history *historyLog // nil when history is disabled
 }
 
-func NewServer() *Server {
+func NewServer(opts serverOptions, auth *authenticator, mod *moderation, history *historyLog) *Server {
 	return &Server{
-		clients: make(map[net.Conn]bool),
+		opts:   opts,
+		auth:   auth,
+		dedupe: newDedupeCache(),
+		mod:    mod,
+
+		transfers: newTransfers(),
+		nextID:    1,
+		history:   history,
+		clients:   make(map[*client]bool),
+		nicks:     make(map[string]*client),
+		rooms:     make(map[string]*room),
+
+		connsPerIP: make(map[string]int),
 	}
 }
 
 func main() {
-	listener, err := net.Listen("tcp", ":8080")
+	addr := flag.String("addr", ":8080", "address to listen on")
+	wsAddr := flag.String("ws-addr", ":8081", "address to accept WebSocket clients on at /ws (empty disables)")
+	historyDir := flag.String("history-dir", "", "directory for the persistent message log (history is disabled unless set)")
+	segmentSize := flag.Int64("history-segment-size", 4<<20, "maximum size in bytes of one history segment file")
+	maxSegments := flag.Int("history-max-segments", 16, "number of history segments to keep (0 for no limit)")
+	retention := flag.Duration("history-retention", 0, "remove history segments older than this (0 to keep them)")
+	storeDMs := flag.Bool("history-store-dms", false, "also write direct messages to the history log")
+	sendQueue := flag.Int("send-queue", 256, "outbound messages buffered per client")
+	slowPolicy := flag.String("slow-consumer", policyDropOldest, "when a client's send queue is full: drop-oldest or disconnect")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "deadline for writing one message to a client")
+	statsInterval := flag.Duration("stats-interval", time.Minute, "log send queue drop counters at this interval (0 disables)")
+	credentials := flag.String("credentials", "", "file of username:bcrypt-hash lines for password logins")
+	tokenSecretFile := flag.String("token-secret-file", "", "file holding the HMAC secret for bearer tokens (default $CHAT_TOKEN_SECRET)")
+	authTimeout := flag.Duration("auth-timeout", 10*time.Second, "time allowed for a new connection to authenticate")
+	maxMessageSize := flag.Int64("max-message-size", 64<<10, "maximum size in bytes of one message from a client")
+	rateLimit := flag.Float64("rate-limit", 5, "messages per second allowed from each client (0 disables)")
+	rateBurst := flag.Int("rate-burst", 10, "messages a client may send in a burst above -rate-limit")
+	floodStrikes := flag.Int("flood-strikes", 5, "rate-limited messages a client is warned about before being disconnected")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 8, "concurrent connections allowed from one IP address (0 disables)")
+	maxFileSize := flag.Int64("max-file-size", 50<<20, "largest file in bytes that clients may send each other")
+	rolesFile := flag.String("roles", "", "file of username:role lines granting admin or moderator")
+	bansFile := flag.String("bans-file", "", "file persisting user and IP bans (bans are kept in memory unless set)")
+	auditLog := flag.String("audit-log", "", "file recording moderation actions as JSON lines (disabled unless set)")
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin, print its bcrypt hash for the credentials file and exit")
+	issueUser := flag.String("issue-token", "", "print a bearer token for this user and exit")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "validity of tokens printed by -issue-token")
+	flag.Parse()
+
+	if *hashPassword {
+		if err := printPasswordHash(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if *issueUser != "" {
+		if err := printToken(*tokenSecretFile, *issueUser, *tokenTTL); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	auth, err := newAuthenticator(authOptions{
+		credentialsFile: *credentials,
+		tokenSecretFile: *tokenSecretFile,
+	})
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	mod, err := newModeration(moderationOptions{
+		rolesFile: *rolesFile,
+		bansFile:  *bansFile,
+		auditLog:  *auditLog,
+	})
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	defer mod.close()
+
+	if err := validatePolicy(*slowPolicy); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if *sendQueue < 1 {
+		log.Fatalf("Error: -send-queue must be at least 1")
+	}
+	if *maxMessageSize < 1 {
+		log.Fatalf("Error: -max-message-size must be positive")
+	}
+	if *rateLimit > 0 && *rateBurst < 1 {
+		log.Fatalf("Error: -rate-burst must be at least 1")
+	}
+
+	var history *historyLog
+	if *historyDir != "" {
+		var err error
+		history, err = openHistory(historyOptions{
+			dir:         *historyDir,
+			segmentSize: *segmentSize,
+			maxSegments: *maxSegments,
+			retention:   *retention,
+		})
+		if err != nil {
+			log.Fatalf("Error opening history: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
 		fmt.Println("Error listening:", err)
 		return
 	}
 	defer listener.Close()
 
-	server := NewServer()
+	server := NewServer(serverOptions{
+		sendQueue:      *sendQueue,
+		slowPolicy:     *slowPolicy,
+		writeTimeout:   *writeTimeout,
+		authTimeout:    *authTimeout,
+		maxMessageSize: *maxMessageSize,
+		rateLimit:      *rateLimit,
+		rateBurst:      *rateBurst,
+		floodStrikes:   *floodStrikes,
+		maxConnsPerIP:  *maxConnsPerIP,
+		maxFileSize:    *maxFileSize,
+		storeDMs:       *storeDMs,
+	}, auth, mod, history)
+	if *statsInterval > 0 {
+		go server.logStats(*statsInterval)
+	}
+
+	fmt.Printf("Server is listening on %s\n", *addr)
 
-	fmt.Printf("Server is listening on %s\n", ":8080")
+	var wsServer *http.Server
+	if *wsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ws", server.handleWebSocket)
+		wsServer = &http.Server{Addr: *wsAddr, Handler: mux}
+		go func() {
+			if err := wsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Error serving WebSocket clients: %v", err)
+			}
+		}()
+		fmt.Printf("Accepting WebSocket clients on %s/ws\n", *wsAddr)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Printf("Received signal %v, shutting down\n", <-sig)
+		listener.Close()
+		if wsServer != nil {
+			wsServer.Close()
+		}
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
 			fmt.Println("Error accepting:", err)
 			continue
 		}
 
 		go server.handleClient(conn)
 	}
+
+	if history != nil {
+		if err := history.close(); err != nil {
+			log.Printf("Error closing history: %v\n", err)
+		}
+	}
 }
 
 func (s *Server) handleClient(conn net.Conn) {
 	defer func() {
-		if err := conn.Close(); err != nil {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			log.Printf("Error closing connection: %v\n", err)
 		}
 	}()
 
-	s.clientsMux.Lock()
-	s.clients[conn] = true
-	s.clientsMux.Unlock()
+	c := newClient(conn, s.opts, &s.stats)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		c.writeLoop(s.opts.writeTimeout)
+	}()
+	defer func() {
+		close(c.done)
+		<-writerDone
+	}()
+
+	ip := remoteIP(conn)
+	if !s.acquireConn(ip) {
+		log.Printf("Rejected %s: too many connections from %s\n", conn.RemoteAddr(), ip)
+		c.send(errorMessage(errorf(ErrTooManyConns, "too many connections from your address")))
+		return
+	}
+	defer s.releaseConn(ip)
+
+	limiter := newSizeLimiter(conn, s.opts.maxMessageSize)
+	decoder := json.NewDecoder(limiter)
+	user, ok := s.login(c, decoder)
+	if !ok {
+		return
+	}
+	limiter.next(decoder.InputOffset())
+	c.user = user
+	nick := s.register(c)
 
 	clientAddr := conn.RemoteAddr().String()
 
-	log.Printf("Accepted connection from %s\n", clientAddr)
+	log.Printf("Accepted connection from %s as %s (nick %s)\n", clientAddr, user, nick)
 	defer func() {
-		s.clientsMux.Lock()
-		delete(s.clients, conn)
-		s.clientsMux.Unlock()
+		if c.slow.Load() {
+			log.Printf("Disconnected slow consumer %s (%s)\n", nick, clientAddr)
+		}
+		if n := c.dropped.Load(); n > 0 {
+			log.Printf("Dropped %d messages for %s (%s)\n", n, nick, clientAddr)
+		}
+
+		s.transfers.cancelAll(c)
+		nick := s.nickOf(c)
+		for _, name := range s.leaveAllRooms(c) {
+			s.broadcastRoom(name, c.stamp(newMessage(TypeLeave, LeaveContent{Room: name, Nick: nick})), nil)
+		}
+		s.unregister(c)
 	}()
 
-	decoder := json.NewDecoder(conn)
+	c.send(systemMessage("Welcome, %s! Your nickname is %s. Send a nick message to change it.", user, nick))
+	if r := s.mod.roleOf(user); r != roleUser {
+		c.send(systemMessage("Your role is %s.", r))
+	}
+	s.joinRoom(c, defaultRoom, true)
+	s.broadcastRoom(defaultRoom, c.stamp(newMessage(TypeJoin, JoinContent{Room: defaultRoom, Nick: nick})), nil)
+	s.sendTopic(c, defaultRoom)
+
+	var rate, requests *rateLimiter
+	if s.opts.rateLimit > 0 {
+		rate = newRateLimiter(s.opts.rateLimit, s.opts.rateBurst, s.opts.floodStrikes)
+		requests = newRateLimiter(s.opts.rateLimit, max(s.opts.rateBurst, requestBurst), s.opts.floodStrikes)
+	}
+
 	for {
 		var msg Message
-		if err := decoder.Decode(&msg); err != nil {
+		err := decoder.Decode(&msg)
+		limiter.next(decoder.InputOffset())
+		if errors.Is(err, errMessageTooLarge) {
+			log.Printf("Disconnecting %s (%s): message exceeds %d bytes\n", s.nickOf(c), clientAddr, s.opts.maxMessageSize)
+			c.send(errorMessage(errorf(ErrTooLarge, "message exceeds %d bytes", s.opts.maxMessageSize)))
+			return
+		}
+		if err != nil {
+			// A value of the wrong type is consumed by the decoder, so
+			// the stream is still usable; anything else is not.
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				c.send(errorMessage(errorf(ErrBadRequest, "invalid message: %v", err)))
+				continue
+			}
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				c.send(errorMessage(errorf(ErrBadRequest, "malformed JSON: %v", err)))
+			}
 			fmt.Printf("Client disconnected: %v\n", err)
 			return
 		}
 
-		fmt.Printf("Received message: %v\n", msg)
+		// Data of an ongoing transfer is paced by its window instead.
+		fileData := s.transfers.paced(c, msg)
+		if rate != nil && !fileData {
+			bucket := rate
+			if msg.Type == TypeJoin || msg.Type == TypeHistory {
+				bucket = requests
+			}
+			ok, disconnect := bucket.allow(time.Now())
+			if disconnect {
+				log.Printf("Disconnecting %s (%s) for flooding\n", s.nickOf(c), clientAddr)
+				c.send(errorMessage(errorf(ErrRateLimited, "disconnected for sending too many messages")))
+				return
+			}
+			if !ok {
+				reply := errorMessage(errorf(ErrRateLimited, "slow down: at most %g messages per second", s.opts.rateLimit))
+				reply.ClientID = msg.ClientID
+				c.send(reply)
+				continue
+			}
+		}
+
+		if !fileData {
+			fmt.Printf("Received message: %s %s\n", msg.Type, msg.Content)
+		}
 
-		s.broadcast(msg, conn)
+		if perr := s.handleMessage(c, msg); perr != nil {
+			reply := errorMessage(perr)
+			reply.ClientID = msg.ClientID
+			c.send(reply)
+		}
 	}
 }
 
-func (s *Server) broadcast(msg Message, sender net.Conn) {
+// handleMessage validates a client message and delivers it. The
+// returned error is reported back to the sender.
+func (s *Server) handleMessage(c *client, msg Message) *protocolError {
+	if msg.ClientID != "" {
+		if len(msg.ClientID) > maxClientIDLen {
+			return errorf(ErrBadRequest, "client_id exceeds %d bytes", maxClientIDLen)
+		}
+		if id, dup := s.dedupe.claim(c.user, msg.ClientID); dup {
+			s.ack(c, msg.ClientID, id, true)
+			return nil
+		}
+		// Without an ack the message was not delivered.
+		defer s.dedupe.release(c.user, msg.ClientID)
+	}
+
+	switch msg.Type {
+	case TypeChat:
+		var content ChatContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		if err := validateRoom(content.Room); err != nil {
+			return err
+		}
+		if err := validateText(content.Text); err != nil {
+			return err
+		}
+		if !s.isMember(c, content.Room) {
+			return errorf(ErrNotMember, "join room %q before sending to it", content.Room)
+		}
+		if err := s.checkMuted(c); err != nil {
+			return err
+		}
+
+		content.From = s.nickOf(c)
+		out, err := s.publish(content.Room, c.stamp(newMessage(TypeChat, content)), func(m Message) {
+			s.broadcastRoom(content.Room, m, c)
+		})
+		if err != nil {
+			return err
+		}
+		s.ack(c, msg.ClientID, out.ID, false)
+
+	case TypeHistory:
+		var content HistoryContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		if err := validateRoom(content.Room); err != nil {
+			return err
+		}
+		if s.history == nil {
+			return errorf(ErrUnavailable, "history is disabled on this server")
+		}
+		if !s.isMember(c, content.Room) {
+			return errorf(ErrNotMember, "join room %q before requesting its history", content.Room)
+		}
+
+		limit := min(content.Last, maxHistory)
+		switch {
+		case limit > 0:
+		case content.Since > 0:
+			limit = maxHistory
+		default:
+			limit = defaultHistory
+		}
+		reply := HistoryContent{Room: content.Room}
+		if content.Since > 0 {
+			// One message more than the page tells whether any remain.
+			msgs, err := s.history.query(content.Room, content.Since, limit+1)
+			if err != nil {
+				log.Printf("Error reading history: %v\n", err)
+				return errorf(ErrUnavailable, "could not read history")
+			}
+			reply.More = len(msgs) > limit
+			reply.Messages = msgs[:min(len(msgs), limit)]
+		} else {
+			msgs, err := s.history.query(content.Room, 0, limit)
+			if err != nil {
+				log.Printf("Error reading history: %v\n", err)
+				return errorf(ErrUnavailable, "could not read history")
+			}
+			reply.Messages = msgs
+		}
+		c.send(newMessage(TypeHistory, reply))
+
+	case TypeJoin:
+		var content JoinContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		if err := validateRoom(content.Room); err != nil {
+			return err
+		}
+
+		joined, err := s.joinRoom(c, content.Room, false)
+		if err != nil {
+			return err
+		}
+		if joined {
+			content.Nick = s.nickOf(c)
+			s.broadcastRoom(content.Room, c.stamp(newMessage(TypeJoin, content)), nil)
+			s.sendTopic(c, content.Room)
+		}
+
+	case TypeCreate:
+		var content CreateContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		if err := validateRoom(content.Room); err != nil {
+			return err
+		}
+
+		if err := s.createRoom(c, content.Room); err != nil {
+			return err
+		}
+		c.send(c.stamp(newMessage(TypeJoin, JoinContent{Room: content.Room, Nick: s.nickOf(c)})))
+
+	case TypeLeave:
+		var content LeaveContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+
+		if err := s.leaveRoom(c, content.Room); err != nil {
+			return err
+		}
+		content.Nick = s.nickOf(c)
+		leave := c.stamp(newMessage(TypeLeave, content))
+		c.send(leave)
+		s.broadcastRoom(content.Room, leave, nil)
+
+	case TypeList:
+		c.send(newMessage(TypeRooms, RoomsContent{Rooms: s.listRooms()}))
+
+	case TypeDM:
+		var content DMContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		if err := validateText(content.Text); err != nil {
+			return err
+		}
+		if err := s.checkMuted(c); err != nil {
+			return err
+		}
+
+		s.clientsMux.RLock()
+		to, ok := s.nicks[content.To]
+		content.From = c.nick
+		s.clientsMux.RUnlock()
+		if !ok {
+			return errorf(ErrNoSuchUser, "no user named %q", content.To)
+		}
+
+		// Direct messages are only logged with storeDMs, and then
+		// under no room, so history requests never return them.
+		out, err := s.publish("", c.stamp(newMessage(TypeDM, content)), to.send)
+		if err != nil {
+			return err
+		}
+		s.ack(c, msg.ClientID, out.ID, false)
+
+	case TypeNick:
+		var content NickContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		if err := validateNick(content.Nick); err != nil {
+			return err
+		}
+
+		old, err := s.rename(c, content.Nick)
+		if err != nil {
+			return err
+		}
+		if old != content.Nick {
+			s.broadcast(c.stamp(newMessage(TypeNick, NickContent{Old: old, Nick: content.Nick})), nil)
+		}
+
+	case TypeTopic:
+		return s.topic(c, msg)
+	case TypeKick:
+		return s.kick(c, msg)
+	case TypeMute:
+		return s.mute(c, msg)
+	case TypeUnmute:
+		return s.unmute(c, msg)
+	case TypeBan:
+		return s.ban(c, msg)
+	case TypeUnban:
+		return s.unban(c, msg)
+
+	case TypeFileOffer, TypeFileAccept, TypeFileChunk, TypeFileAck, TypeFileDone, TypeFileCancel:
+		return s.handleFile(c, msg)
+
+	case TypeAuth:
+		return errorf(ErrBadRequest, "already authenticated")
+
+	case TypeRooms, TypeAck, TypeSystem, TypeError:
+		return errorf(ErrBadRequest, "%s messages can only be sent by the server", msg.Type)
+
+	default:
+		return errorf(ErrUnknownType, "unknown message type %q", msg.Type)
+	}
+	return nil
+}
+
+// register adds c with its username as nickname, adding a numeric
+// suffix if the name is in use, and returns the nickname.
+func (s *Server) register(c *client) string {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	c.nick = c.user
+	for n := 2; ; n++ {
+		if _, taken := s.nicks[c.nick]; !taken {
+			break
+		}
+		c.nick = fmt.Sprintf("%s-%d", c.user, n)
+	}
+	s.clients[c] = true
+	s.nicks[c.nick] = c
+	return c.nick
+}
+
+func (s *Server) unregister(c *client) {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	delete(s.clients, c)
+	delete(s.nicks, c.nick)
+}
+
+// rename changes the nickname of c and returns the previous one.
+func (s *Server) rename(c *client, nick string) (string, *protocolError) {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	old := c.nick
+	if owner, taken := s.nicks[nick]; taken && owner != c {
+		return old, errorf(ErrNickTaken, "nickname %q is already in use", nick)
+	}
+
+	delete(s.nicks, old)
+	s.nicks[nick] = c
+	c.nick = nick
+	return old, nil
+}
+
+func (s *Server) nickOf(c *client) string {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+	return c.nick
+}
+
+// broadcast sends msg to every client except sender, which may be nil.
+func (s *Server) broadcast(msg Message, sender *client) {
 	s.clientsMux.RLock()
 	defer s.clientsMux.RUnlock()
 
 	for client := range s.clients {
 		if client != sender {
-			encoder := json.NewEncoder(client)
-			if err := encoder.Encode(msg); err != nil {
-				fmt.Printf("Error broadcasting to client: %v\n", err)
-			}
+			client.send(msg)
+		}
+	}
+}
+
+// logStats periodically logs the send queue counters when they change.
+func (s *Server) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastDropped, lastDisconnects uint64
+	for range ticker.C {
+		dropped := s.stats.dropped.Load()
+		disconnects := s.stats.slowDisconnects.Load()
+		if dropped == lastDropped && disconnects == lastDisconnects {
+			continue
 		}
+		log.Printf("Send queues: %d messages dropped, %d slow consumers disconnected\n", dropped, disconnects)
+		lastDropped, lastDisconnects = dropped, disconnects
 	}
 }
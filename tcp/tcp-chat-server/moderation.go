@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles, in increasing order of privilege. Moderators may kick, mute and
+// set room topics; admins may also ban. Nobody can act on a user whose
+// role is equal to or higher than their own.
+type role int
+
+const (
+	roleUser role = iota
+	roleModerator
+	roleAdmin
+)
+
+func (r role) String() string {
+	switch r {
+	case roleAdmin:
+		return "admin"
+	case roleModerator:
+		return "moderator"
+	default:
+		return "user"
+	}
+}
+
+type moderationOptions struct {
+	rolesFile string
+	bansFile  string // empty keeps bans in memory only
+	auditLog  string // empty logs audit entries to the server log only
+}
+
+// moderation holds the role assignments, bans and mutes, and records
+// every moderation action in the audit log.
+type moderation struct {
+	roles map[string]role // by username; read-only after startup
+
+	mu       sync.Mutex
+	bans     []banEntry
+	bansFile string
+	mutes    map[string]time.Time // username to end of mute
+
+	auditMux sync.Mutex
+	audit    *os.File // nil when there is no audit log file
+}
+
+// banEntry bans either a username or an IP address. A nil Until bans
+// permanently.
+type banEntry struct {
+	User    string     `json:"user,omitempty"`
+	IP      string     `json:"ip,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+	By      string     `json:"by"`
+	Reason  string     `json:"reason,omitempty"`
+	Created time.Time  `json:"created"`
+}
+
+func (b banEntry) expired(now time.Time) bool {
+	return b.Until != nil && now.After(*b.Until)
+}
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time   time.Time  `json:"time"`
+	Actor  string     `json:"actor"`
+	Action string     `json:"action"`
+	Target string     `json:"target,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+	Detail string     `json:"detail,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+	Denied bool       `json:"denied,omitempty"`
+}
+
+func newModeration(opts moderationOptions) (*moderation, error) {
+	m := &moderation{
+		roles:    make(map[string]role),
+		bansFile: opts.bansFile,
+		mutes:    make(map[string]time.Time),
+	}
+
+	if opts.rolesFile != "" {
+		roles, err := loadRoles(opts.rolesFile)
+		if err != nil {
+			return nil, err
+		}
+		m.roles = roles
+	}
+
+	if opts.bansFile != "" {
+		b, err := os.ReadFile(opts.bansFile)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, fmt.Errorf("could not read bans file: %w", err)
+		default:
+			if err := json.Unmarshal(b, &m.bans); err != nil {
+				return nil, fmt.Errorf("could not parse bans file: %w", err)
+			}
+		}
+	}
+
+	if opts.auditLog != "" {
+		f, err := os.OpenFile(opts.auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("could not open audit log: %w", err)
+		}
+		m.audit = f
+	}
+	return m, nil
+}
+
+// loadRoles reads "username:role" lines, where role is admin or
+// moderator. Blank lines and lines starting with # are ignored.
+func loadRoles(path string) (map[string]role, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open roles file: %w", err)
+	}
+	defer f.Close()
+
+	roles := make(map[string]role)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, name, ok := strings.Cut(line, ":")
+		if !ok || validateNick(user) != nil {
+			return nil, fmt.Errorf("%s:%d: expected username:role", path, n)
+		}
+		switch strings.TrimSpace(name) {
+		case "admin":
+			roles[user] = roleAdmin
+		case "moderator":
+			roles[user] = roleModerator
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown role %q (want admin or moderator)", path, n, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read roles file: %w", err)
+	}
+	return roles, nil
+}
+
+func (m *moderation) close() error {
+	if m.audit == nil {
+		return nil
+	}
+	return m.audit.Close()
+}
+
+func (m *moderation) roleOf(user string) role {
+	return m.roles[user]
+}
+
+// banned returns the ban matching user or ip, if any. Either may be
+// empty.
+func (m *moderation) banned(user, ip string) (banEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, b := range m.bans {
+		if b.expired(now) {
+			continue
+		}
+		if (user != "" && b.User == user) || (ip != "" && b.IP == ip) {
+			return b, true
+		}
+	}
+	return banEntry{}, false
+}
+
+// ban adds b, replacing any earlier ban of the same user or IP, and
+// saves the ban list.
+func (m *moderation) ban(b banEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeBan(b.User, b.IP)
+	m.bans = append(m.bans, b)
+	return m.saveBans()
+}
+
+// unban lifts the bans of user or ip and reports whether there were any.
+func (m *moderation) unban(user, ip string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.removeBan(user, ip) {
+		return false, nil
+	}
+	return true, m.saveBans()
+}
+
+// removeBan drops the bans matching user or ip along with expired ones.
+// The caller must hold mu.
+func (m *moderation) removeBan(user, ip string) bool {
+	now := time.Now()
+	found := false
+	m.bans = slices.DeleteFunc(m.bans, func(b banEntry) bool {
+		match := (user != "" && b.User == user) || (ip != "" && b.IP == ip)
+		found = found || (match && !b.expired(now))
+		return match || b.expired(now)
+	})
+	return found
+}
+
+// saveBans atomically replaces the bans file. The caller must hold mu.
+func (m *moderation) saveBans() error {
+	if m.bansFile == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(m.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.bansFile), ".bans-*")
+	if err != nil {
+		return fmt.Errorf("could not save bans: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save bans: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save bans: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.bansFile); err != nil {
+		return fmt.Errorf("could not save bans: %w", err)
+	}
+	return nil
+}
+
+// mutedUntil returns when the mute of user ends, if user is muted.
+func (m *moderation) mutedUntil(user string) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	until, ok := m.mutes[user]
+	if ok && time.Now().After(until) {
+		delete(m.mutes, user)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+func (m *moderation) mute(user string, until time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mutes[user] = until
+}
+
+func (m *moderation) unmute(user string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	until, ok := m.mutes[user]
+	delete(m.mutes, user)
+	return ok && time.Now().Before(until)
+}
+
+// record writes entry to the audit log file and the server log.
+func (m *moderation) record(entry auditEntry) {
+	entry.Time = time.Now().UTC()
+
+	outcome := ""
+	if entry.Denied {
+		outcome = " (denied)"
+	}
+	log.Printf("Audit: %s %s %s%s\n", entry.Actor, entry.Action, entry.Target, outcome)
+
+	if m.audit == nil {
+		return
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	m.auditMux.Lock()
+	defer m.auditMux.Unlock()
+	if _, err := m.audit.Write(append(b, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v\n", err)
+	}
+}
+
+// authorize checks that c may perform action, which requires need, on
+// targetUser (empty when the action has no target user). Refusals are
+// audited as well.
+func (s *Server) authorize(c *client, action string, need role, targetUser, target string) *protocolError {
+	have := s.mod.roleOf(c.user)
+	var err *protocolError
+	switch {
+	case have < need:
+		err = errorf(ErrForbidden, "%s requires the %s role", action, need)
+	case targetUser == c.user:
+		err = errorf(ErrForbidden, "you cannot %s yourself", action)
+	case targetUser != "" && s.mod.roleOf(targetUser) >= have:
+		err = errorf(ErrForbidden, "%s has the %s role", target, s.mod.roleOf(targetUser))
+	}
+	if err != nil {
+		s.mod.record(auditEntry{Actor: c.user, Action: action, Target: target, Denied: true})
+	}
+	return err
+}
+
+// clientByNick returns the connected client using nick.
+func (s *Server) clientByNick(nick string) (*client, *protocolError) {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+
+	target, ok := s.nicks[nick]
+	if !ok {
+		return nil, errorf(ErrNoSuchUser, "no user named %q", nick)
+	}
+	return target, nil
+}
+
+// disconnectWhere sends notice to every client matching and disconnects
+// it. The notice is flushed before the connection closes.
+func (s *Server) disconnectWhere(match func(*client) bool, notice Message) []string {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+
+	var nicks []string
+	for c := range s.clients {
+		if match(c) {
+			c.send(notice)
+			c.disconnect()
+			nicks = append(nicks, c.nick)
+		}
+	}
+	return nicks
+}
+
+func (s *Server) kick(c *client, msg Message) *protocolError {
+	var content KickContent
+	if err := decodeContent(msg, &content); err != nil {
+		return err
+	}
+	if err := validateReason(content.Reason); err != nil {
+		return err
+	}
+	target, err := s.clientByNick(content.Nick)
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(c, "kick", roleModerator, target.user, content.Nick); err != nil {
+		return err
+	}
+
+	s.mod.record(auditEntry{Actor: c.user, Action: "kick", Target: target.user, Reason: content.Reason})
+	target.send(errorMessage(errorf(ErrKicked, "you were kicked by %s%s", c.user, reasonSuffix(content.Reason))))
+	target.disconnect()
+	s.broadcast(systemMessage("%s was kicked by %s%s", content.Nick, c.user, reasonSuffix(content.Reason)), target)
+	return nil
+}
+
+func (s *Server) mute(c *client, msg Message) *protocolError {
+	var content MuteContent
+	if err := decodeContent(msg, &content); err != nil {
+		return err
+	}
+	if err := validateReason(content.Reason); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(content.Duration)
+	if err != nil || d <= 0 {
+		return errorf(ErrBadRequest, "mute duration must be a positive duration such as 10m")
+	}
+	target, perr := s.clientByNick(content.Nick)
+	if perr != nil {
+		return perr
+	}
+	if err := s.authorize(c, "mute", roleModerator, target.user, content.Nick); err != nil {
+		return err
+	}
+
+	until := time.Now().Add(d).UTC()
+	s.mod.mute(target.user, until)
+	s.mod.record(auditEntry{Actor: c.user, Action: "mute", Target: target.user, Reason: content.Reason, Until: &until})
+	s.broadcast(systemMessage("%s was muted by %s for %v%s", content.Nick, c.user, d, reasonSuffix(content.Reason)), nil)
+	return nil
+}
+
+func (s *Server) unmute(c *client, msg Message) *protocolError {
+	var content MuteContent
+	if err := decodeContent(msg, &content); err != nil {
+		return err
+	}
+	target, err := s.clientByNick(content.Nick)
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(c, "unmute", roleModerator, target.user, content.Nick); err != nil {
+		return err
+	}
+
+	if !s.mod.unmute(target.user) {
+		return errorf(ErrBadRequest, "%s is not muted", content.Nick)
+	}
+	s.mod.record(auditEntry{Actor: c.user, Action: "unmute", Target: target.user})
+	s.broadcast(systemMessage("%s was unmuted by %s", content.Nick, c.user), nil)
+	return nil
+}
+
+// ban bans a username or an IP address and disconnects the clients it
+// matches. A nickname in use is resolved to its user; any other value
+// is taken as a username, so users can be banned while offline.
+func (s *Server) ban(c *client, msg Message) *protocolError {
+	var content BanContent
+	if err := decodeContent(msg, &content); err != nil {
+		return err
+	}
+	if err := validateReason(content.Reason); err != nil {
+		return err
+	}
+	user, ip, target, perr := s.banTarget(content)
+	if perr != nil {
+		return perr
+	}
+	if err := s.authorize(c, "ban", roleAdmin, user, target); err != nil {
+		return err
+	}
+	if ip != "" && ip == remoteIP(c.conn) {
+		return errorf(ErrForbidden, "you cannot ban your own address")
+	}
+
+	entry := banEntry{User: user, IP: ip, By: c.user, Reason: content.Reason, Created: time.Now().UTC()}
+	if content.Duration != "" {
+		d, err := time.ParseDuration(content.Duration)
+		if err != nil || d <= 0 {
+			return errorf(ErrBadRequest, "ban duration must be a positive duration such as 24h, or omitted")
+		}
+		until := entry.Created.Add(d)
+		entry.Until = &until
+	}
+	if err := s.mod.ban(entry); err != nil {
+		log.Printf("Error saving bans: %v\n", err)
+		return errorf(ErrUnavailable, "could not save the ban")
+	}
+	s.mod.record(auditEntry{Actor: c.user, Action: "ban", Target: target, Reason: content.Reason, Until: entry.Until})
+
+	notice := errorMessage(errorf(ErrBanned, "you were banned by %s%s", c.user, reasonSuffix(content.Reason)))
+	kicked := s.disconnectWhere(func(other *client) bool {
+		if other == c || s.mod.roleOf(other.user) >= s.mod.roleOf(c.user) {
+			return false
+		}
+		return (user != "" && other.user == user) || (ip != "" && remoteIP(other.conn) == ip)
+	}, notice)
+	s.broadcast(systemMessage("%s was banned by %s%s", target, c.user, reasonSuffix(content.Reason)), nil)
+	if len(kicked) > 0 {
+		c.send(systemMessage("Disconnected %s", strings.Join(kicked, ", ")))
+	}
+	return nil
+}
+
+func (s *Server) unban(c *client, msg Message) *protocolError {
+	var content BanContent
+	if err := decodeContent(msg, &content); err != nil {
+		return err
+	}
+	user, ip, target, perr := s.banTarget(content)
+	if perr != nil {
+		return perr
+	}
+	if err := s.authorize(c, "unban", roleAdmin, "", target); err != nil {
+		return err
+	}
+
+	found, err := s.mod.unban(user, ip)
+	if err != nil {
+		log.Printf("Error saving bans: %v\n", err)
+		return errorf(ErrUnavailable, "could not save the ban list")
+	}
+	if !found {
+		return errorf(ErrBadRequest, "%s is not banned", target)
+	}
+	s.mod.record(auditEntry{Actor: c.user, Action: "unban", Target: target})
+	c.send(systemMessage("%s is no longer banned", target))
+	return nil
+}
+
+// banTarget resolves the user or IP address named by content and
+// returns it along with a description for notices.
+func (s *Server) banTarget(content BanContent) (user, ip, target string, err *protocolError) {
+	switch {
+	case (content.Nick == "") == (content.IP == ""):
+		return "", "", "", errorf(ErrBadRequest, "specify either nick or ip")
+	case content.IP != "":
+		addr, perr := netip.ParseAddr(content.IP)
+		if perr != nil {
+			return "", "", "", errorf(ErrBadRequest, "invalid IP address %q", content.IP)
+		}
+		ip = addr.Unmap().String()
+		return "", ip, ip, nil
+	}
+
+	if err := validateNick(content.Nick); err != nil {
+		return "", "", "", err
+	}
+	user = content.Nick
+	if c, err := s.clientByNick(content.Nick); err == nil {
+		user = c.user
+	}
+	return user, "", user, nil
+}
+
+// topic shows or changes the topic of a room c is in. Anyone in the
+// room may read it; changing it takes a moderator.
+func (s *Server) topic(c *client, msg Message) *protocolError {
+	var content TopicContent
+	if err := decodeContent(msg, &content); err != nil {
+		return err
+	}
+	if err := validateRoom(content.Room); err != nil {
+		return err
+	}
+	if !s.isMember(c, content.Room) {
+		return errorf(ErrNotMember, "you are not in room %q", content.Room)
+	}
+
+	if content.Topic == nil {
+		c.send(s.topicMessage(content.Room))
+		return nil
+	}
+	if *content.Topic != "" {
+		if err := validateText(*content.Topic); err != nil {
+			return err
+		}
+		if len(*content.Topic) > maxTopicLen {
+			return errorf(ErrBadRequest, "topic exceeds %d bytes", maxTopicLen)
+		}
+	}
+	if err := s.authorize(c, "topic", roleModerator, "", content.Room); err != nil {
+		return err
+	}
+
+	s.clientsMux.Lock()
+	if r, ok := s.rooms[content.Room]; ok {
+		r.topic, r.topicBy = *content.Topic, c.user
+	}
+	s.clientsMux.Unlock()
+
+	s.mod.record(auditEntry{Actor: c.user, Action: "topic", Target: content.Room, Detail: *content.Topic})
+	s.broadcastRoom(content.Room, s.topicMessage(content.Room), nil)
+	return nil
+}
+
+// sendTopic tells c the topic of room, if it has one.
+func (s *Server) sendTopic(c *client, room string) {
+	s.clientsMux.RLock()
+	r, ok := s.rooms[room]
+	hasTopic := ok && r.topic != ""
+	s.clientsMux.RUnlock()
+
+	if hasTopic {
+		c.send(s.topicMessage(room))
+	}
+}
+
+// topicMessage returns the current topic of room.
+func (s *Server) topicMessage(room string) Message {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+
+	content := TopicContent{Room: room}
+	if r, ok := s.rooms[room]; ok {
+		content.Topic, content.SetBy = &r.topic, r.topicBy
+	}
+	return newMessage(TypeTopic, content)
+}
+
+// checkMuted rejects messages from muted users.
+func (s *Server) checkMuted(c *client) *protocolError {
+	if until, muted := s.mod.mutedUntil(c.user); muted {
+		left := (time.Until(until) + time.Second - 1).Truncate(time.Second)
+		return errorf(ErrMuted, "you are muted for another %v", left)
+	}
+	return nil
+}
+
+// checkBanned rejects banned users and connections from banned
+// addresses. Either user or conn may be unset.
+func (s *Server) checkBanned(user string, conn net.Conn) *protocolError {
+	ip := ""
+	if conn != nil {
+		ip = remoteIP(conn)
+	}
+	b, ok := s.mod.banned(user, ip)
+	if !ok {
+		return nil
+	}
+	if b.Until != nil {
+		return errorf(ErrBanned, "you are banned until %s%s", b.Until.Format(time.RFC3339), reasonSuffix(b.Reason))
+	}
+	return errorf(ErrBanned, "you are banned%s", reasonSuffix(b.Reason))
+}
+
+func remoteIP(conn net.Conn) string {
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return addr.Addr().Unmap().WithZone("").String()
+}
+
+func validateReason(reason string) *protocolError {
+	if len(reason) > maxTopicLen {
+		return errorf(ErrBadRequest, "reason exceeds %d bytes", maxTopicLen)
+	}
+	return nil
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types. Clients must send auth first and may then send join,
+// leave, create, list, history, nick, chat, dm and topic, and with the
+// right role kick, mute, unmute, ban and unban; rooms, ack, system and
+// error are generated by the server, which also relays join, leave and
+// topic changes to the members of the room. The file_* messages are
+// relayed between the two clients taking part in a file transfer.
+const (
+	TypeAuth    = "auth"
+	TypeJoin    = "join"
+	TypeLeave   = "leave"
+	TypeCreate  = "create"
+	TypeList    = "list"
+	TypeRooms   = "rooms"
+	TypeHistory = "history"
+	TypeNick    = "nick"
+	TypeChat    = "chat"
+	TypeDM      = "dm"
+	TypeSystem  = "system"
+	TypeError   = "error"
+	TypeAck     = "ack"
+	TypeTopic   = "topic"
+	TypeKick    = "kick"
+	TypeMute    = "mute"
+	TypeUnmute  = "unmute"
+	TypeBan     = "ban"
+	TypeUnban   = "unban"
+
+	TypeFileOffer  = "file_offer"
+	TypeFileAccept = "file_accept"
+	TypeFileChunk  = "file_chunk"
+	TypeFileAck    = "file_ack"
+	TypeFileDone   = "file_done"
+	TypeFileCancel = "file_cancel"
+)
+
+// Message is the envelope for every frame on the wire. Content holds
+// the payload struct matching Type.
+//
+// The server assigns chat and dm messages a monotonically increasing
+// ID and stamps messages relayed on behalf of a user with From, that
+// user's authenticated identity, and Time. ClientID is an optional
+// idempotency key chosen by the sender: the server acknowledges such
+// messages with an ack, delivers each ClientID at most once, and echoes
+// it on errors.
+type Message struct {
+	ID       uint64          `json:"id,omitempty"`
+	ClientID string          `json:"client_id,omitempty"`
+	From     string          `json:"from,omitempty"`
+	Time     *time.Time      `json:"time,omitempty"`
+	Type     string          `json:"type"`
+	Content  json.RawMessage `json:"content,omitempty"`
+}
+
+// AuthContent carries either a username and password or a bearer
+// token. The server answers a successful login with the authenticated
+// Username.
+type AuthContent struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// JoinContent asks to join a room. The server relays it to the room's
+// members with Nick filled in.
+type JoinContent struct {
+	Room string `json:"room"`
+	Nick string `json:"nick,omitempty"`
+}
+
+// LeaveContent asks to leave a room. The server relays it to the
+// remaining members with Nick filled in, also when a member disconnects.
+type LeaveContent struct {
+	Room string `json:"room"`
+	Nick string `json:"nick,omitempty"`
+}
+
+// CreateContent creates a room and joins it.
+type CreateContent struct {
+	Room string `json:"room"`
+}
+
+// RoomsContent answers a list request.
+type RoomsContent struct {
+	Rooms []RoomInfo `json:"rooms"`
+}
+
+// HistoryContent requests stored messages of a room the client is in:
+// the Last messages, or with Since set up to Last messages newer than
+// that ID (maxHistory if Last is unset). The server replies with
+// Messages filled in and, for Since requests, More set when newer
+// messages remain; the client then asks again with Since set to the
+// last ID received.
+type HistoryContent struct {
+	Room     string    `json:"room"`
+	Last     int       `json:"last,omitempty"`
+	Since    uint64    `json:"since,omitempty"`
+	Messages []Message `json:"messages,omitempty"`
+	More     bool      `json:"more,omitempty"`
+}
+
+type RoomInfo struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// NickContent requests a nickname change from a client; the server
+// broadcasts it with Old filled in.
+type NickContent struct {
+	Old  string `json:"old,omitempty"`
+	Nick string `json:"nick"`
+}
+
+// ChatContent is a message to everyone in Room. From is set by the
+// server.
+type ChatContent struct {
+	Room string `json:"room"`
+	From string `json:"from,omitempty"`
+	Text string `json:"text"`
+}
+
+// DMContent is a private message to a single user. From is set by the
+// server.
+type DMContent struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+// TopicContent asks for the topic of Room when Topic is omitted, and
+// otherwise sets it, an empty Topic clearing it. The server sends it on
+// join and to the room's members when the topic changes, with SetBy
+// filled in.
+type TopicContent struct {
+	Room  string  `json:"room"`
+	Topic *string `json:"topic,omitempty"`
+	SetBy string  `json:"set_by,omitempty"`
+}
+
+// KickContent disconnects the user using Nick.
+type KickContent struct {
+	Nick   string `json:"nick"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// MuteContent stops the user using Nick from sending chat and direct
+// messages for Duration, such as "10m". unmute takes only Nick.
+type MuteContent struct {
+	Nick     string `json:"nick"`
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// BanContent bans, or with unban lifts the ban of, either a user or an
+// IP address. Nick is resolved to the user behind it when in use and
+// taken as a username otherwise. Without a Duration the ban is
+// permanent.
+type BanContent struct {
+	Nick     string `json:"nick,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// FileOfferContent offers the file Name of Size bytes to the user
+// using To. ID is chosen by the sender, unique among its transfers,
+// and names the transfer in its later messages. The server replaces it
+// with an ID of its own in the offer it forwards, and the recipient uses
+// that one instead. SHA256 is the hex checksum of the whole file. From
+// is set by the server.
+//
+// The recipient answers with file_accept, or file_cancel to decline.
+// The sender then sends file_chunk messages numbered from 0 and, once
+// all data is sent, file_done. The recipient confirms every chunk with
+// file_ack, and the sender may not run more than eight chunks ahead of
+// those. Either side may send file_cancel at any time; the server sends
+// it to both when a transfer fails.
+type FileOfferContent struct {
+	ID     string `json:"id"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type FileAcceptContent struct {
+	ID string `json:"id"`
+}
+
+// FileChunkContent carries part of a file. Data is base64 encoded on
+// the wire.
+type FileChunkContent struct {
+	ID   string `json:"id"`
+	Seq  uint64 `json:"seq"`
+	Data []byte `json:"data"`
+}
+
+// FileAckContent confirms chunks up to and including Seq.
+type FileAckContent struct {
+	ID  string `json:"id"`
+	Seq uint64 `json:"seq"`
+}
+
+type FileDoneContent struct {
+	ID string `json:"id"`
+}
+
+type FileCancelContent struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SystemContent is an informational notice from the server.
+type SystemContent struct {
+	Text string `json:"text"`
+}
+
+// AckContent confirms that the message sent with ClientID was accepted
+// as ID. Duplicate is set when it had already been delivered before.
+type AckContent struct {
+	ClientID  string `json:"client_id"`
+	ID        uint64 `json:"id"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// ErrorContent reports a rejected client message.
+type ErrorContent struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes sent in ErrorContent.
+const (
+	ErrBadRequest   = "bad_request"
+	ErrUnknownType  = "unknown_type"
+	ErrInvalidNick  = "invalid_nick"
+	ErrNickTaken    = "nick_taken"
+	ErrNoSuchUser   = "no_such_user"
+	ErrInvalidRoom  = "invalid_room"
+	ErrRoomExists   = "room_exists"
+	ErrNoSuchRoom   = "no_such_room"
+	ErrNotMember    = "not_member"
+	ErrUnavailable  = "unavailable"
+	ErrAuthRequired = "auth_required"
+	ErrAuthFailed   = "auth_failed"
+	ErrForbidden    = "forbidden"
+	ErrMuted        = "muted"
+	ErrBanned       = "banned"
+	ErrKicked       = "kicked"
+	ErrTooLarge     = "too_large"
+	ErrRateLimited  = "rate_limited"
+	ErrTooManyConns = "too_many_connections"
+
+	ErrNoSuchTransfer = "no_such_transfer"
+)
+
+const (
+	maxTextLen  = 4096
+	maxTopicLen = 256
+)
+
+var (
+	nickPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+	roomPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+// protocolError is returned by validation and sent back to the client
+// as an error message.
+type protocolError struct {
+	code    string
+	message string
+}
+
+func (e *protocolError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func errorf(code, format string, args ...any) *protocolError {
+	return &protocolError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func newMessage(typ string, content any) Message {
+	raw, err := json.Marshal(content)
+	if err != nil {
+		// The payload structs hold only plain values, so this cannot happen.
+		panic(fmt.Sprintf("encoding %s content: %v", typ, err))
+	}
+	return Message{Type: typ, Content: raw}
+}
+
+func errorMessage(err *protocolError) Message {
+	return newMessage(TypeError, ErrorContent{Code: err.code, Message: err.message})
+}
+
+func systemMessage(format string, args ...any) Message {
+	return newMessage(TypeSystem, SystemContent{Text: fmt.Sprintf(format, args...)})
+}
+
+// decodeContent unmarshals msg.Content into v, rejecting unknown fields.
+func decodeContent(msg Message, v any) *protocolError {
+	if len(msg.Content) == 0 {
+		return errorf(ErrBadRequest, "%s message has no content", msg.Type)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(msg.Content))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errorf(ErrBadRequest, "invalid %s content: %v", msg.Type, err)
+	}
+	return nil
+}
+
+func validateNick(nick string) *protocolError {
+	if !nickPattern.MatchString(nick) {
+		return errorf(ErrInvalidNick, "nickname must be 1-32 letters, digits, '_' or '-'")
+	}
+	return nil
+}
+
+func validateRoom(room string) *protocolError {
+	if !roomPattern.MatchString(room) {
+		return errorf(ErrInvalidRoom, "room name must be 1-32 lowercase letters, digits, '_' or '-'")
+	}
+	return nil
+}
+
+func validateText(text string) *protocolError {
+	switch {
+	case strings.TrimSpace(text) == "":
+		return errorf(ErrBadRequest, "text must not be empty")
+	case len(text) > maxTextLen:
+		return errorf(ErrBadRequest, "text exceeds %d bytes", maxTextLen)
+	case !utf8.ValidString(text):
+		return errorf(ErrBadRequest, "text must be valid UTF-8")
+	}
+	return nil
+}
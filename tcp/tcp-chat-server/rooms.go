@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// defaultRoom is joined automatically by every new client.
+const defaultRoom = "lobby"
+
+type room struct {
+	name    string
+	members map[*client]bool
+	topic   string
+	topicBy string
+}
+
+// createRoom creates name and makes c its first member.
+func (s *Server) createRoom(c *client, name string) *protocolError {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	if _, exists := s.rooms[name]; exists {
+		return errorf(ErrRoomExists, "room %q already exists", name)
+	}
+
+	r := &room{name: name, members: make(map[*client]bool)}
+	s.rooms[name] = r
+	s.addMember(r, c)
+	log.Printf("Room %s created by %s\n", name, c.nick)
+	return nil
+}
+
+// joinRoom adds c to an existing room, or creates it when create is set.
+// It reports whether c was not already a member.
+func (s *Server) joinRoom(c *client, name string, create bool) (bool, *protocolError) {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	r, ok := s.rooms[name]
+	if !ok {
+		if !create {
+			return false, errorf(ErrNoSuchRoom, "no room named %q", name)
+		}
+		r = &room{name: name, members: make(map[*client]bool)}
+		s.rooms[name] = r
+	}
+	if r.members[c] {
+		return false, nil
+	}
+
+	s.addMember(r, c)
+	return true, nil
+}
+
+// leaveRoom removes c from name, deleting the room once it is empty.
+func (s *Server) leaveRoom(c *client, name string) *protocolError {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	r, ok := c.rooms[name]
+	if !ok {
+		return errorf(ErrNotMember, "you are not in room %q", name)
+	}
+	s.removeMember(r, c)
+	return nil
+}
+
+// leaveAllRooms removes c from every room and returns their names.
+func (s *Server) leaveAllRooms(c *client) []string {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	names := make([]string, 0, len(c.rooms))
+	for name, r := range c.rooms {
+		s.removeMember(r, c)
+		names = append(names, name)
+	}
+	return names
+}
+
+// addMember and removeMember keep room and client membership in sync.
+// The caller must hold clientsMux.
+func (s *Server) addMember(r *room, c *client) {
+	r.members[c] = true
+	c.rooms[r.name] = r
+}
+
+func (s *Server) removeMember(r *room, c *client) {
+	delete(r.members, c)
+	delete(c.rooms, r.name)
+	if len(r.members) == 0 {
+		delete(s.rooms, r.name)
+		log.Printf("Room %s is empty, removed\n", r.name)
+	}
+}
+
+func (s *Server) isMember(c *client, name string) bool {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+
+	_, ok := c.rooms[name]
+	return ok
+}
+
+// listRooms returns every room with its members, sorted by name.
+func (s *Server) listRooms() []RoomInfo {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+
+	rooms := make([]RoomInfo, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		info := RoomInfo{Name: r.name, Members: make([]string, 0, len(r.members))}
+		for c := range r.members {
+			info.Members = append(info.Members, c.nick)
+		}
+		sort.Strings(info.Members)
+		rooms = append(rooms, info)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// broadcastRoom sends msg to every member of name except sender, which
+// may be nil.
+func (s *Server) broadcastRoom(name string, msg Message, sender *client) {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+
+	r, ok := s.rooms[name]
+	if !ok {
+		return
+	}
+	for member := range r.members {
+		if member != sender {
+			member.send(msg)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A file travels as file_chunk messages of at most maxFileChunk bytes.
+// The sender may run fileWindow chunks ahead of the recipient's
+// file_ack messages, which bounds how much of either send queue a
+// transfer occupies so that chat messages keep flowing alongside it.
+const (
+	maxFileChunk          = 32 << 10
+	fileWindow            = 8
+	maxTransfersPerClient = 4
+	maxFileNameLen        = 255
+)
+
+var transferIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// transfer is a file offered by one client to another, relayed chunk by
+// chunk. The server checks sequence numbers, the declared size and the
+// checksum as the data passes through.
+//
+// The sender names the transfer with its own id, which need only be
+// unique among its transfers, and the recipient with ref, which the
+// server assigns. Messages are relayed with the id of the side they go
+// to, so no client can guess or collide with another's transfer.
+type transfer struct {
+	id       string
+	ref      string
+	from, to *client
+	name     string
+	size     int64
+	sum      string
+
+	accepted bool
+	nextSeq  uint64 // next chunk expected from the sender
+	acked    uint64 // chunks confirmed by the recipient
+	received int64
+	hash     hash.Hash
+}
+
+type transferKey struct {
+	from *client
+	id   string
+}
+
+type transfers struct {
+	mu      sync.Mutex
+	byID    map[transferKey]*transfer // by sender and the sender's id
+	byRef   map[string]*transfer
+	nextRef uint64
+}
+
+func newTransfers() *transfers {
+	return &transfers{
+		byID:  make(map[transferKey]*transfer),
+		byRef: make(map[string]*transfer),
+	}
+}
+
+// handleFile relays the file transfer messages between two clients.
+func (s *Server) handleFile(c *client, msg Message) *protocolError {
+	switch msg.Type {
+	case TypeFileOffer:
+		return s.offerFile(c, msg)
+
+	case TypeFileAccept:
+		var content FileAcceptContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		s.transfers.mu.Lock()
+		defer s.transfers.mu.Unlock()
+
+		t, err := s.transfers.received(c, content.ID)
+		if err != nil {
+			return err
+		}
+		if t.accepted {
+			return errorf(ErrBadRequest, "transfer %s was already accepted", t.ref)
+		}
+		t.accepted = true
+		content.ID = t.id
+		t.from.send(newMessage(TypeFileAccept, content))
+
+	case TypeFileChunk:
+		var content FileChunkContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		s.transfers.mu.Lock()
+		defer s.transfers.mu.Unlock()
+
+		t, err := s.transfers.sent(c, content.ID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !t.accepted:
+			return errorf(ErrBadRequest, "transfer %s has not been accepted", t.id)
+		case content.Seq != t.nextSeq:
+			return errorf(ErrBadRequest, "expected chunk %d of transfer %s, got %d", t.nextSeq, t.id, content.Seq)
+		case len(content.Data) == 0 || len(content.Data) > maxFileChunk:
+			return errorf(ErrBadRequest, "chunks must hold 1 to %d bytes", maxFileChunk)
+		case t.received+int64(len(content.Data)) > t.size:
+			s.transfers.cancel(t, "more data than offered")
+			return nil
+		case t.nextSeq-t.acked >= fileWindow:
+			return errorf(ErrBadRequest, "wait for file_ack before sending more than %d chunks", fileWindow)
+		}
+		t.nextSeq++
+		t.received += int64(len(content.Data))
+		t.hash.Write(content.Data)
+		content.ID = t.ref
+		t.to.send(newMessage(TypeFileChunk, content))
+
+	case TypeFileAck:
+		var content FileAckContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		s.transfers.mu.Lock()
+		defer s.transfers.mu.Unlock()
+
+		t, err := s.transfers.received(c, content.ID)
+		if err != nil {
+			return err
+		}
+		if content.Seq < t.acked || content.Seq >= t.nextSeq {
+			return errorf(ErrBadRequest, "chunk %d of transfer %s has not been sent", content.Seq, t.ref)
+		}
+		t.acked = content.Seq + 1
+		content.ID = t.id
+		t.from.send(newMessage(TypeFileAck, content))
+
+	case TypeFileDone:
+		var content FileDoneContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		s.transfers.mu.Lock()
+		defer s.transfers.mu.Unlock()
+
+		t, err := s.transfers.sent(c, content.ID)
+		if err != nil {
+			return err
+		}
+		if t.received != t.size || hex.EncodeToString(t.hash.Sum(nil)) != t.sum {
+			s.transfers.cancel(t, "data does not match the offered size and checksum")
+			return nil
+		}
+		s.transfers.remove(t)
+		content.ID = t.ref
+		t.to.send(newMessage(TypeFileDone, content))
+		log.Printf("Transferred %s (%d bytes) from %s to %s\n", t.name, t.size, t.from.user, t.to.user)
+
+	case TypeFileCancel:
+		var content FileCancelContent
+		if err := decodeContent(msg, &content); err != nil {
+			return err
+		}
+		s.transfers.mu.Lock()
+		defer s.transfers.mu.Unlock()
+
+		t, err := s.transfers.sent(c, content.ID)
+		if err != nil {
+			if t, err = s.transfers.received(c, content.ID); err != nil {
+				return err
+			}
+		}
+		if len(content.Reason) > maxTopicLen {
+			content.Reason = content.Reason[:maxTopicLen]
+		}
+		s.transfers.cancel(t, content.Reason)
+	}
+	return nil
+}
+
+func (s *Server) offerFile(c *client, msg Message) *protocolError {
+	var content FileOfferContent
+	if err := decodeContent(msg, &content); err != nil {
+		return err
+	}
+	switch {
+	case !transferIDPattern.MatchString(content.ID):
+		return errorf(ErrBadRequest, "transfer id must be 1-64 letters, digits, '_' or '-'")
+	case content.Size <= 0 || content.Size > s.opts.maxFileSize:
+		return errorf(ErrTooLarge, "files must be 1 to %d bytes", s.opts.maxFileSize)
+	case !validFileName(content.Name):
+		return errorf(ErrBadRequest, "invalid file name")
+	}
+	if sum, err := hex.DecodeString(content.SHA256); err != nil || len(sum) != sha256.Size {
+		return errorf(ErrBadRequest, "sha256 must be %d hex digits", 2*sha256.Size)
+	}
+	content.SHA256 = strings.ToLower(content.SHA256)
+	if err := s.checkMuted(c); err != nil {
+		return err
+	}
+
+	to, err := s.clientByNick(content.To)
+	if err != nil {
+		return err
+	}
+	if to == c {
+		return errorf(ErrBadRequest, "cannot send a file to yourself")
+	}
+
+	s.transfers.mu.Lock()
+	defer s.transfers.mu.Unlock()
+
+	key := transferKey{from: c, id: content.ID}
+	if _, exists := s.transfers.byID[key]; exists {
+		return errorf(ErrBadRequest, "transfer id %q is in use", content.ID)
+	}
+	active := 0
+	for k := range s.transfers.byID {
+		if k.from == c {
+			active++
+		}
+	}
+	if active >= maxTransfersPerClient {
+		return errorf(ErrBadRequest, "at most %d transfers may be offered at once", maxTransfersPerClient)
+	}
+
+	s.transfers.nextRef++
+	t := &transfer{
+		id:   content.ID,
+		ref:  "t" + strconv.FormatUint(s.transfers.nextRef, 10),
+		from: c,
+		to:   to,
+		name: content.Name,
+		size: content.Size,
+		sum:  content.SHA256,
+		hash: sha256.New(),
+	}
+	s.transfers.byID[key] = t
+	s.transfers.byRef[t.ref] = t
+	content.ID = t.ref
+	content.From = s.nickOf(c)
+	to.send(c.stamp(newMessage(TypeFileOffer, content)))
+	return nil
+}
+
+// sent returns the transfer c offered as id. The caller must hold mu.
+func (ts *transfers) sent(c *client, id string) (*transfer, *protocolError) {
+	t, ok := ts.byID[transferKey{from: c, id: id}]
+	if !ok {
+		return nil, errorf(ErrNoSuchTransfer, "no transfer %q", id)
+	}
+	return t, nil
+}
+
+// received returns the transfer offered to c as ref. The caller must
+// hold mu.
+func (ts *transfers) received(c *client, ref string) (*transfer, *protocolError) {
+	t, ok := ts.byRef[ref]
+	if !ok || t.to != c {
+		return nil, errorf(ErrNoSuchTransfer, "no transfer %q", ref)
+	}
+	return t, nil
+}
+
+// remove forgets t. The caller must hold mu.
+func (ts *transfers) remove(t *transfer) {
+	delete(ts.byID, transferKey{from: t.from, id: t.id})
+	delete(ts.byRef, t.ref)
+}
+
+// paced reports whether msg is a file_chunk or file_ack of an accepted
+// transfer in which c is the sender or recipient respectively. Such
+// frames are bounded by fileWindow rather than the rate limiter.
+func (ts *transfers) paced(c *client, msg Message) bool {
+	if msg.Type != TypeFileChunk && msg.Type != TypeFileAck {
+		return false
+	}
+	var ref struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(msg.Content, &ref) != nil {
+		return false
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var t *transfer
+	var err *protocolError
+	if msg.Type == TypeFileChunk {
+		t, err = ts.sent(c, ref.ID)
+	} else {
+		t, err = ts.received(c, ref.ID)
+	}
+	return err == nil && t.accepted
+}
+
+// cancel ends t and tells both sides why. The caller must hold mu.
+func (ts *transfers) cancel(t *transfer, reason string) {
+	ts.remove(t)
+	t.from.send(newMessage(TypeFileCancel, FileCancelContent{ID: t.id, Reason: reason}))
+	t.to.send(newMessage(TypeFileCancel, FileCancelContent{ID: t.ref, Reason: reason}))
+}
+
+// cancelAll ends the transfers c takes part in when it disconnects.
+func (ts *transfers) cancelAll(c *client) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, t := range ts.byID {
+		if t.from == c || t.to == c {
+			ts.cancel(t, "peer disconnected")
+		}
+	}
+}
+
+// validFileName accepts a plain file name without any directory part,
+// since recipients save files under the offered name.
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		len(name) <= maxFileNameLen && utf8.ValidString(name) &&
+		filepath.Base(name) == name && !strings.ContainsAny(name, `/\`+"\x00")
+}
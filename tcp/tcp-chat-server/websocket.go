@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The auth message travels inside the connection rather than in a
+// cookie, so a page from another origin gains nothing by connecting and
+// any origin is accepted.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// handleWebSocket upgrades the request and serves it like a TCP
+// connection, so browser clients share the client set, rooms and
+// limits. Each WebSocket message carries one Message as JSON.
+//
+// The connection gets no read limit of its own: that would send a
+// close frame before the client could be told why, while the decoder's
+// size limit already stops an oversized message with a too_large error.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading %s: %v\n", r.RemoteAddr, err)
+		return
+	}
+
+	s.handleClient(&wsConn{ws: ws})
+}
+
+// wsConn adapts a WebSocket connection to net.Conn. Reads return the
+// payloads of consecutive messages, separated by newlines; each Write
+// is sent as one text message, which matches json.Encoder writing one
+// value per call.
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader // current message, nil between messages
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if c.reader == nil {
+			_, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				// Keep message boundaries visible to the decoder.
+				p[0] = '\n'
+				return 1, nil
+			}
+			return n, nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame when possible before closing the
+// connection.
+func (c *wsConn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+// abort closes conn without waiting on the peer. Callers of send may
+// hold locks, and a WebSocket close frame could wait up to a second
+// behind writes that a slow client is not reading.
+func abort(conn net.Conn) {
+	if ws, ok := conn.(*wsConn); ok {
+		ws.ws.UnderlyingConn().Close()
+		return
+	}
+	conn.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
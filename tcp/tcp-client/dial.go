@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// parseDialAddr maps unix:///path and unix://@name (a Linux abstract
+// socket) to the unix network; anything else is a TCP host:port.
+func parseDialAddr(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+type proxyOptions struct {
+	version string
+	src     string
+}
+
+// endpointList holds the configured server endpoints in order of
+// preference. Dialing starts at the current endpoint and moves on to the
+// next one when it cannot be reached or its connection is lost.
+type endpointList struct {
+	addrs   []string
+	current atomic.Int64
+}
+
+func parseEndpoints(s string) (*endpointList, error) {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no server address given")
+	}
+	return &endpointList{addrs: addrs}, nil
+}
+
+func (l *endpointList) String() string {
+	return strings.Join(l.addrs, ",")
+}
+
+// failover makes the endpoint after the current one the first to try.
+func (l *endpointList) failover() {
+	if len(l.addrs) > 1 {
+		l.current.Add(1)
+	}
+}
+
+// dial tries each endpoint once, starting with the current one, and
+// remembers the endpoint that succeeded.
+func (o *options) dial(ctx context.Context) (net.Conn, error) {
+	start := int(o.endpoints.current.Load())
+	n := len(o.endpoints.addrs)
+
+	var errs []error
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		addr := o.endpoints.addrs[idx]
+
+		attemptCtx, cancel := context.WithTimeout(ctx, o.dialTimeout)
+		conn, err := dial(attemptCtx, addr, o.tlsConfig, o.proxy, o.attemptDelay)
+		cancel()
+		if err == nil {
+			o.endpoints.current.Store(int64(idx))
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dial connects to addr, sending a PROXY header if requested and then
+// performing the TLS handshake if tlsConfig is set.
+func dial(ctx context.Context, addr string, tlsConfig *tls.Config, proxy proxyOptions, attemptDelay time.Duration) (net.Conn, error) {
+	network, address := parseDialAddr(addr)
+
+	var conn net.Conn
+	var err error
+	if network == "tcp" {
+		conn, err = dialHappyEyeballs(ctx, address, attemptDelay)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy.version != "" {
+		if network != "tcp" {
+			conn.Close()
+			return nil, fmt.Errorf("PROXY headers require a TCP connection")
+		}
+
+		src := conn.LocalAddr().(*net.TCPAddr)
+		if proxy.src != "" {
+			src, err = net.ResolveTCPAddr("tcp", proxy.src)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("invalid PROXY source address: %w", err)
+			}
+		}
+
+		if err := writeProxyHeader(conn, proxy.version, src, conn.RemoteAddr().(*net.TCPAddr)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error sending PROXY header: %w", err)
+		}
+	}
+
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	if tlsConfig.ServerName == "" {
+		host := "localhost"
+		if network == "tcp" {
+			host, _, err = net.SplitHostPort(address)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialHappyEyeballs resolves every A and AAAA record of address and races
+// connection attempts as described in RFC 8305: addresses alternate
+// between families starting with IPv6, a new attempt starts every
+// attemptDelay or as soon as the previous one fails, and the first
+// established connection wins.
+func dialHappyEyeballs(ctx context.Context, address string, attemptDelay time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	targets := sortAddrsRFC8305(ips)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+
+	var d net.Dialer
+	next, pending := 0, 0
+	startAttempt := func() {
+		target := net.JoinHostPort(targets[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp", target)
+			results <- result{conn, err}
+		}()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var errs []error
+	for {
+		if pending == 0 && next == len(targets) {
+			return nil, errors.Join(errs...)
+		}
+
+		select {
+		case <-timer.C:
+			if next < len(targets) {
+				startAttempt()
+				timer.Reset(attemptDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+
+			errs = append(errs, r.err)
+			if next < len(targets) {
+				startAttempt()
+				timer.Reset(attemptDelay)
+			}
+		}
+	}
+}
+
+// sortAddrsRFC8305 interleaves IPv6 and IPv4 addresses, IPv6 first,
+// keeping the resolver's order within each family.
+func sortAddrsRFC8305(ips []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	sorted := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lineConn serializes writes so heartbeat replies from the read loop do
+// not interleave with lines from stdin.
+type lineConn struct {
+	net.Conn
+	mu           sync.Mutex
+	writeTimeout time.Duration
+}
+
+func (c *lineConn) writeLine(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(c.Conn, line)
+	return err
+}
+
+// closeWrite half-closes the connection so the server sees EOF while its
+// remaining output can still be read.
+func (c *lineConn) closeWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// runInteractive streams stdin to the server and the server to stdout
+// like netcat, reconnecting with exponential backoff when the server
+// goes away. Lines typed while disconnected are sent after reconnecting.
+func runInteractive(ctx context.Context, opts *options) error {
+	lines := make(chan string, 64)
+	go readStdin(lines)
+
+	var pending string
+	backoff := time.Duration(0)
+
+	for {
+		conn, err := opts.dial(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !opts.reconnect {
+				return fmt.Errorf("error dialing: %w", err)
+			}
+
+			backoff = nextBackoff(backoff, opts.backoffMin, opts.backoffMax)
+			delay := withJitter(backoff)
+			log.Printf("Error dialing %s: %s; retrying in %v", opts.endpoints, err, delay.Round(time.Millisecond))
+			if !sleepContext(ctx, delay) {
+				return nil
+			}
+			continue
+		}
+		backoff = 0
+		log.Printf("Connected to %s", conn.RemoteAddr())
+
+		lc := &lineConn{Conn: conn, writeTimeout: opts.writeTimeout}
+		var stdinDone bool
+		pending, stdinDone, err = streamConn(ctx, lc, lines, pending)
+		conn.Close()
+
+		switch {
+		case ctx.Err() != nil, stdinDone:
+			return nil
+		case !opts.reconnect:
+			return err
+		}
+		log.Printf("Connection lost: %s", err)
+		opts.endpoints.failover()
+	}
+}
+
+// streamConn pumps lines to conn and conn to stdout until the connection
+// fails, ctx is cancelled or stdin is exhausted and the server has
+// finished replying. It returns a line that could not be delivered.
+func streamConn(ctx context.Context, conn *lineConn, lines <-chan string, pending string) (string, bool, error) {
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- copyToStdout(conn)
+	}()
+
+	if pending != "" {
+		if err := conn.writeLine(pending); err != nil {
+			return pending, false, err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		case err := <-readErr:
+			if err == nil {
+				err = io.EOF
+			}
+			return "", false, err
+		case line, ok := <-lines:
+			if !ok {
+				conn.closeWrite()
+				select {
+				case <-ctx.Done():
+				case <-readErr:
+				}
+				return "", true, nil
+			}
+			if err := conn.writeLine(line); err != nil {
+				return line, false, err
+			}
+		}
+	}
+}
+
+// copyToStdout prints server output, answering heartbeat PING lines.
+func copyToStdout(conn *lineConn) error {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if strings.TrimRight(line, "\r\n") == pingLine {
+				if werr := conn.writeLine(pongLine + "\n"); werr != nil {
+					return werr
+				}
+				continue
+			}
+			os.Stdout.WriteString(line)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// readStdin sends each line of stdin, newline included, then closes lines.
+func readStdin(lines chan<- string) {
+	defer close(lines)
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			lines <- line
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Error reading from stdin: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// nextBackoff doubles the previous delay, keeping it within [lo, hi].
+func nextBackoff(prev, lo, hi time.Duration) time.Duration {
+	return min(max(prev*2, lo), hi)
+}
+
+// withJitter returns a random delay between d/2 and d, so reconnecting
+// clients do not retry in lockstep.
+func withJitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
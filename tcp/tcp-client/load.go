@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+type loadOptions struct {
+	conns    int
+	rate     float64 // total messages per second, 0 for as fast as possible
+	duration time.Duration
+	msgSize  int
+	report   string
+}
+
+// latencyHistogram records durations in logarithmic buckets with
+// histSubBuckets linear sub-buckets per power of two, bounding both
+// memory and relative error (about 6%).
+type latencyHistogram struct {
+	counts [64 * histSubBuckets]uint64
+	total  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+const histSubBuckets = 16
+
+func histBucket(d time.Duration) int {
+	v := uint64(d)
+	if v < histSubBuckets {
+		return int(v)
+	}
+	exp := bits.Len64(v) - 5 // keep the top five bits: 1 + log2(histSubBuckets)
+	return exp*histSubBuckets + int(v>>exp)
+}
+
+// histUpperBound is the largest duration mapped to bucket i.
+func histUpperBound(i int) time.Duration {
+	if i < histSubBuckets {
+		return time.Duration(i)
+	}
+	exp := i/histSubBuckets - 1
+	mantissa := uint64(i%histSubBuckets + histSubBuckets)
+	return time.Duration((mantissa+1)<<exp - 1)
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	h.counts[histBucket(d)]++
+	h.total++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.total += o.total
+	h.sum += o.sum
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+
+	// Nearest rank: the smallest value with at least p percent of the
+	// samples at or below it.
+	rank := uint64(math.Ceil(p / 100 * float64(h.total)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			return min(histUpperBound(i), h.max)
+		}
+	}
+	return h.max
+}
+
+func (h *latencyHistogram) mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.total)
+}
+
+type workerStats struct {
+	sent      uint64
+	received  uint64
+	bytesSent uint64
+	errors    map[string]uint64
+	latency   latencyHistogram
+}
+
+func (w *workerStats) fail(err error) {
+	w.errors[classifyLoadError(err)]++
+}
+
+func classifyLoadError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	default:
+		return "other"
+	}
+}
+
+// runLoad opens opts.load.conns connections and exchanges newline framed
+// messages with the server until the duration elapses, then prints a
+// throughput and latency report.
+func runLoad(ctx context.Context, opts *options) error {
+	lo := opts.load
+	ctx, cancel := context.WithTimeout(ctx, lo.duration)
+	defer cancel()
+
+	var interval time.Duration
+	if lo.rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(lo.conns) / lo.rate)
+	}
+
+	payload := strings.Repeat("x", lo.msgSize) + "\n"
+
+	stats := make([]*workerStats, lo.conns)
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i := range stats {
+		stats[i] = &workerStats{errors: make(map[string]uint64)}
+		var sched *sendSchedule
+		if interval > 0 {
+			// Stagger the workers so the sends spread over each interval.
+			sched = &sendSchedule{
+				next:     start.Add(interval * time.Duration(i) / time.Duration(lo.conns)),
+				interval: interval,
+			}
+		}
+		wg.Add(1)
+		go func(ws *workerStats) {
+			defer wg.Done()
+			loadWorker(ctx, opts, ws, payload, sched)
+		}(stats[i])
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := &workerStats{errors: make(map[string]uint64)}
+	for _, ws := range stats {
+		total.sent += ws.sent
+		total.received += ws.received
+		total.bytesSent += ws.bytesSent
+		for k, n := range ws.errors {
+			total.errors[k] += n
+		}
+		total.latency.merge(&ws.latency)
+	}
+
+	report := newLoadReport(lo, total, elapsed)
+	if lo.report == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	report.writeTable(os.Stdout)
+	return nil
+}
+
+// sendSchedule spaces sends interval apart from a fixed start. A send
+// that falls behind is made as soon as possible instead of skipped, and
+// its latency is counted from the time it was due, so a slow server
+// shows up in the percentiles rather than as a lower offered rate.
+type sendSchedule struct {
+	next     time.Time
+	interval time.Duration
+}
+
+// wait blocks until the next send is due and returns when it was due.
+func (s *sendSchedule) wait(ctx context.Context) (time.Time, error) {
+	due := s.next
+	s.next = s.next.Add(s.interval)
+
+	if d := time.Until(due); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return due, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return due, nil
+}
+
+// loadWorker runs request/response exchanges on a single connection,
+// closed-loop or paced by sched, redialing after errors until ctx is
+// done.
+func loadWorker(ctx context.Context, opts *options, ws *workerStats, payload string, sched *sendSchedule) {
+	for ctx.Err() == nil {
+		conn, err := opts.dial(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			ws.fail(err)
+			sleepContext(ctx, opts.backoffMin)
+			continue
+		}
+
+		err = exchangeLoop(ctx, conn, ws, payload, sched, opts.timeout)
+		conn.Close()
+		if err != nil && ctx.Err() == nil {
+			ws.fail(err)
+		}
+	}
+}
+
+func exchangeLoop(ctx context.Context, conn net.Conn, ws *workerStats, payload string, sched *sendSchedule, timeout time.Duration) error {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	for {
+		sentAt := time.Now()
+		if sched != nil {
+			due, err := sched.wait(ctx)
+			if err != nil {
+				return nil
+			}
+			sentAt = due
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+
+		if _, err := io.WriteString(conn, payload); err != nil {
+			return err
+		}
+		ws.sent++
+		ws.bytesSent += uint64(len(payload))
+
+		if _, err := readResponse(conn, reader); err != nil {
+			return err
+		}
+		ws.received++
+		ws.latency.record(time.Since(sentAt))
+	}
+}
+
+type loadReport struct {
+	Connections   int               `json:"connections"`
+	Duration      float64           `json:"duration_seconds"`
+	Sent          uint64            `json:"sent"`
+	Received      uint64            `json:"received"`
+	TargetRate    float64           `json:"target_rate_msgs_per_second,omitempty"`
+	SendRate      float64           `json:"send_rate_msgs_per_second"`
+	Throughput    float64           `json:"throughput_msgs_per_second"`
+	BytesPerSec   float64           `json:"throughput_bytes_per_second"`
+	Errors        map[string]uint64 `json:"errors"`
+	LatencyMeanMs float64           `json:"latency_mean_ms"`
+	LatencyP50Ms  float64           `json:"latency_p50_ms"`
+	LatencyP90Ms  float64           `json:"latency_p90_ms"`
+	LatencyP99Ms  float64           `json:"latency_p99_ms"`
+	LatencyMaxMs  float64           `json:"latency_max_ms"`
+}
+
+func newLoadReport(lo loadOptions, total *workerStats, elapsed time.Duration) *loadReport {
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	secs := elapsed.Seconds()
+
+	return &loadReport{
+		Connections:   lo.conns,
+		Duration:      secs,
+		Sent:          total.sent,
+		Received:      total.received,
+		TargetRate:    lo.rate,
+		SendRate:      float64(total.sent) / secs,
+		Throughput:    float64(total.received) / secs,
+		BytesPerSec:   float64(total.bytesSent) / secs,
+		Errors:        total.errors,
+		LatencyMeanMs: ms(total.latency.mean()),
+		LatencyP50Ms:  ms(total.latency.percentile(50)),
+		LatencyP90Ms:  ms(total.latency.percentile(90)),
+		LatencyP99Ms:  ms(total.latency.percentile(99)),
+		LatencyMaxMs:  ms(total.latency.max),
+	}
+}
+
+func (r *loadReport) writeTable(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Connections\t%d\n", r.Connections)
+	fmt.Fprintf(tw, "Duration\t%.2fs\n", r.Duration)
+	fmt.Fprintf(tw, "Messages\t%d sent, %d received\n", r.Sent, r.Received)
+	if r.TargetRate > 0 {
+		fmt.Fprintf(tw, "Send rate\t%.1f msg/s of %.1f msg/s target\n", r.SendRate, r.TargetRate)
+	}
+	fmt.Fprintf(tw, "Throughput\t%.1f msg/s, %.1f KiB/s\n", r.Throughput, r.BytesPerSec/1024)
+
+	errs := "none"
+	if len(r.Errors) > 0 {
+		var parts []string
+		for _, k := range []string{"timeout", "eof", "reset", "refused", "other"} {
+			if n := r.Errors[k]; n > 0 {
+				parts = append(parts, fmt.Sprintf("%s=%d", k, n))
+			}
+		}
+		errs = strings.Join(parts, " ")
+	}
+	fmt.Fprintf(tw, "Errors\t%s\n", errs)
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "Latency\tmean\tp50\tp90\tp99\tmax")
+	fmt.Fprintf(tw, "(ms)\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\n",
+		r.LatencyMeanMs, r.LatencyP50Ms, r.LatencyP90Ms, r.LatencyP99Ms, r.LatencyMaxMs)
+	tw.Flush()
+}
@@ -1,40 +1,206 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// Heartbeat lines from the server start with an ASCII DLE control byte,
+// which sets them apart from replies that happen to read PING.
+const (
+	pingLine = "\x10PING"
+	pongLine = "\x10PONG"
+)
+
+type options struct {
+	endpoints    *endpointList
+	mode         string
+	dialTimeout  time.Duration
+	attemptDelay time.Duration
+	timeout      time.Duration
+	writeTimeout time.Duration
+	reconnect    bool
+	backoffMin   time.Duration
+	backoffMax   time.Duration
+	tlsConfig    *tls.Config
+	proxy        proxyOptions
+	load         loadOptions
+}
+
+// go run .
+// go run . localhost:9090
+// go run . -tls -tls-insecure
+// go run . -tls -tls-ca ca.pem -tls-cert client.pem -tls-key client-key.pem
+// go run . -proxy-header v2 -proxy-src 203.0.113.7:51234
+// go run . unix:///tmp/tcp-server.sock
+// go run . -mode interactive -addr localhost:9090
+// go run . -mode interactive -addr node1.example.com:8080,node2.example.com:8080
+// go run . -mode load -conns 50 -rate 5000 -duration 30s -report json
 func main() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	opts, err := parseFlags()
+	if err != nil {
+		log.Fatalf("Error parsing flags: %s", err.Error())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	var d net.Dialer
-	conn, err := d.DialContext(ctx, "tcp", "localhost:8080")
+	switch opts.mode {
+	case "interactive":
+		err = runInteractive(ctx, opts)
+	case "load":
+		err = runLoad(ctx, opts)
+	default:
+		err = runOnce(opts)
+	}
 	if err != nil {
-		log.Fatalf("Error dialing: %s", err.Error())
+		log.Fatalf("Error: %s", err.Error())
+	}
+}
+
+func parseFlags() (*options, error) {
+	addr := flag.String("addr", "localhost:8080", "comma-separated server endpoints, tried in order: host:port, unix:///path or unix://@name")
+	mode := flag.String("mode", "once", "once: send a single message; interactive: stream stdin and stdout; load: generate load and report latency")
+	dialTimeout := flag.Duration("dial-timeout", 10*time.Second, "timeout for establishing a connection to one endpoint")
+	attemptDelay := flag.Duration("attempt-delay", 250*time.Millisecond, "delay between racing connection attempts to an endpoint's addresses (RFC 8305)")
+	timeout := flag.Duration("timeout", 5*time.Second, "deadline for each exchange in once and load mode")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "per-line write timeout in interactive mode")
+	reconnect := flag.Bool("reconnect", true, "reconnect when the server drops the connection in interactive mode")
+	backoffMin := flag.Duration("backoff-min", 500*time.Millisecond, "initial reconnect delay")
+	backoffMax := flag.Duration("backoff-max", 30*time.Second, "maximum reconnect delay")
+	conns := flag.Int("conns", 10, "concurrent connections in load mode")
+	rate := flag.Float64("rate", 0, "total messages per second in load mode (0 for as fast as possible)")
+	duration := flag.Duration("duration", 10*time.Second, "how long to generate load")
+	msgSize := flag.Int("msg-size", 64, "message payload size in bytes in load mode")
+	report := flag.String("report", "table", "load report format: table or json")
+	useTLS := flag.Bool("tls", false, "connect using TLS")
+	tlsCA := flag.String("tls-ca", "", "CA file (PEM) used to verify the server certificate")
+	tlsCert := flag.String("tls-cert", "", "client certificate file (PEM) for mutual TLS")
+	tlsKey := flag.String("tls-key", "", "client private key file (PEM) for mutual TLS")
+	tlsServerName := flag.String("tls-server-name", "", "server name to verify, defaults to the dialed host")
+	tlsInsecure := flag.Bool("tls-insecure", false, "skip server certificate verification")
+	proxyHeader := flag.String("proxy-header", "", "send a PROXY protocol header first: v1 or v2")
+	proxySrc := flag.String("proxy-src", "", "client address announced in the PROXY header, defaults to the local address")
+	flag.Parse()
+
+	switch *mode {
+	case "once", "interactive", "load":
+	default:
+		return nil, fmt.Errorf("invalid mode: %s", *mode)
+	}
+
+	if *mode == "load" {
+		if *conns < 1 || *msgSize < 0 || *duration <= 0 || *rate < 0 {
+			return nil, fmt.Errorf("invalid load parameters")
+		}
+		if *report != "table" && *report != "json" {
+			return nil, fmt.Errorf("invalid report format: %s", *report)
+		}
+	}
+
+	if *backoffMin <= 0 || *backoffMax < *backoffMin {
+		return nil, fmt.Errorf("invalid backoff range: %v-%v", *backoffMin, *backoffMax)
+	}
+
+	tlsConfig, err := newTLSConfig(tlsOptions{
+		enabled:    *useTLS,
+		caFile:     *tlsCA,
+		certFile:   *tlsCert,
+		keyFile:    *tlsKey,
+		serverName: *tlsServerName,
+		insecure:   *tlsInsecure,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error configuring TLS: %w", err)
+	}
+
+	if flag.NArg() > 0 {
+		*addr = flag.Arg(0)
+	}
+
+	endpoints, err := parseEndpoints(*addr)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &options{
+		endpoints:    endpoints,
+		mode:         *mode,
+		dialTimeout:  *dialTimeout,
+		attemptDelay: *attemptDelay,
+		timeout:      *timeout,
+		writeTimeout: *writeTimeout,
+		reconnect:    *reconnect,
+		backoffMin:   *backoffMin,
+		backoffMax:   *backoffMax,
+		tlsConfig:    tlsConfig,
+		proxy:        proxyOptions{version: *proxyHeader, src: *proxySrc},
+		load: loadOptions{
+			conns:    *conns,
+			rate:     *rate,
+			duration: *duration,
+			msgSize:  *msgSize,
+			report:   *report,
+		},
+	}
+	return opts, nil
+}
+
+// runOnce sends a single greeting and prints the response.
+func runOnce(opts *options) error {
+	conn, err := opts.dial(context.Background())
+	if err != nil {
+		return fmt.Errorf("error dialing: %w", err)
 	}
 	defer conn.Close()
+	log.Printf("Connected to %s", conn.RemoteAddr())
 
-	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
-		log.Fatalf("Error setting deadline: %s", err.Error())
+	if err := conn.SetDeadline(time.Now().Add(opts.timeout)); err != nil {
+		return fmt.Errorf("error setting deadline: %w", err)
 	}
 
 	msg := []byte("Hello from client\n")
 
 	_, err = conn.Write(msg)
 	if err != nil {
-		log.Fatalf("Error writing: %s", err.Error())
+		return fmt.Errorf("error writing: %w", err)
 	}
 
-	response := make([]byte, 1024)
-	_, err = conn.Read(response)
+	response, err := readResponse(conn, bufio.NewReader(conn))
 	if err != nil {
-		log.Fatalf("Error reading: %s", err.Error())
+		return fmt.Errorf("error reading: %w", err)
 	}
 
-	fmt.Printf("Response from server: %s", string(response))
+	fmt.Printf("Response from server: %s", response)
+	return nil
+}
+
+// readResponse returns the next line from the server, answering any
+// heartbeat PING lines with PONG on the way.
+func readResponse(conn net.Conn, reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		if strings.TrimRight(line, "\r\n") == pingLine {
+			if _, err := conn.Write([]byte(pongLine + "\n")); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		return line, nil
+	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader sends a HAProxy PROXY protocol header announcing src
+// as the client address, for testing servers behind a load balancer.
+func writeProxyHeader(w io.Writer, version string, src, dst *net.TCPAddr) error {
+	var header []byte
+	switch version {
+	case "v1":
+		header = proxyV1Header(src, dst)
+	case "v2":
+		header = proxyV2Header(src, dst)
+	default:
+		return fmt.Errorf("invalid PROXY protocol version: %s", version)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+func proxyV1Header(src, dst *net.TCPAddr) []byte {
+	proto := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(0x21) // version 2, PROXY command
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP != nil && dstIP != nil {
+		buf.WriteByte(0x11) // TCP over IPv4
+		binary.Write(&buf, binary.BigEndian, uint16(12))
+	} else {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		buf.WriteByte(0x21) // TCP over IPv6
+		binary.Write(&buf, binary.BigEndian, uint16(36))
+	}
+
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+type framingMode string
+
+const (
+	framingNewline framingMode = "newline"
+	framingLength  framingMode = "length"
+	framingVarint  framingMode = "varint"
+	framingRESP    framingMode = "resp"
+)
+
+var errFrameTooLarge = errors.New("frame exceeds maximum message size")
+
+// frameCodec reads and writes whole messages on a connection.
+// ReadFrame must reject a frame larger than the configured maximum
+// before buffering its payload; the limit does not apply to writes.
+type frameCodec interface {
+	ReadFrame() ([]byte, error)
+	WriteFrame(payload []byte) error
+}
+
+func parseFramingMode(s string) (framingMode, error) {
+	switch framingMode(s) {
+	case framingNewline, framingLength, framingVarint, framingRESP:
+		return framingMode(s), nil
+	default:
+		return "", fmt.Errorf("invalid framing mode: %s", s)
+	}
+}
+
+func newFrameCodec(mode framingMode, rw io.ReadWriter, maxSize int) frameCodec {
+	r := bufio.NewReader(rw)
+	switch mode {
+	case framingLength:
+		return &lengthCodec{r: r, w: rw, maxSize: maxSize}
+	case framingVarint:
+		return &varintCodec{r: r, w: rw, maxSize: maxSize}
+	case framingRESP:
+		return &respCodec{r: r, w: rw, maxSize: maxSize}
+	default:
+		return &lineCodec{r: r, w: rw, maxSize: maxSize}
+	}
+}
+
+// lineCodec frames messages as text terminated by '\n'.
+// The delimiter counts towards maxSize.
+type lineCodec struct {
+	r       *bufio.Reader
+	w       io.Writer
+	maxSize int
+}
+
+func (c *lineCodec) ReadFrame() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		if len(line)+len(chunk) > c.maxSize {
+			return nil, errFrameTooLarge
+		}
+		line = append(line, chunk...)
+
+		switch {
+		case err == nil:
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			return bytes.TrimSuffix(line, []byte("\r")), nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(line) > 0:
+			return nil, io.ErrUnexpectedEOF
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (c *lineCodec) WriteFrame(payload []byte) error {
+	buf := make([]byte, 0, len(payload)+1)
+	buf = append(buf, payload...)
+	buf = append(buf, '\n')
+	_, err := c.w.Write(buf)
+	return err
+}
+
+// lengthCodec frames messages with a 4-byte big-endian length prefix.
+type lengthCodec struct {
+	r       *bufio.Reader
+	w       io.Writer
+	maxSize int
+}
+
+func (c *lengthCodec) ReadFrame() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+	if uint64(n) > uint64(c.maxSize) {
+		return nil, errFrameTooLarge
+	}
+
+	return readPayload(c.r, int(n))
+}
+
+func (c *lengthCodec) WriteFrame(payload []byte) error {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return errFrameTooLarge
+	}
+
+	buf := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	_, err := c.w.Write(buf)
+	return err
+}
+
+// varintCodec frames messages with an unsigned varint length prefix.
+type varintCodec struct {
+	r       *bufio.Reader
+	w       io.Writer
+	maxSize int
+}
+
+func (c *varintCodec) ReadFrame() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > uint64(c.maxSize) {
+		return nil, errFrameTooLarge
+	}
+
+	return readPayload(c.r, int(n))
+}
+
+func (c *varintCodec) WriteFrame(payload []byte) error {
+	buf := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(payload)), uint64(len(payload)))
+	buf = append(buf, payload...)
+	_, err := c.w.Write(buf)
+	return err
+}
+
+func readPayload(r io.Reader, n int) ([]byte, error) {
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type handlerKind string
+
+const (
+	handlerEcho handlerKind = "echo"
+	handlerRESP handlerKind = "resp"
+)
+
+// commandHandler turns one request frame into one response frame.
+// A nil response sends nothing back.
+type commandHandler interface {
+	Handle(msg []byte) []byte
+}
+
+func parseHandlerKind(s string) (handlerKind, error) {
+	switch handlerKind(s) {
+	case handlerEcho, handlerRESP:
+		return handlerKind(s), nil
+	default:
+		return "", fmt.Errorf("invalid handler: %s", s)
+	}
+}
+
+func newCommandHandler(kind handlerKind) commandHandler {
+	switch kind {
+	case handlerRESP:
+		return newRESPHandler(newKVStore())
+	default:
+		return echoHandler{}
+	}
+}
+
+type echoHandler struct{}
+
+func (echoHandler) Handle(msg []byte) []byte {
+	return []byte(processMessage(string(msg)))
+}
+
+// respHandler serves a subset of the Redis command set over RESP2.
+type respHandler struct {
+	store    *kvStore
+	commands map[string]func(args [][]byte) []byte
+}
+
+func newRESPHandler(store *kvStore) *respHandler {
+	h := &respHandler{store: store}
+	h.commands = map[string]func(args [][]byte) []byte{
+		"ping":   h.ping,
+		"get":    h.get,
+		"set":    h.set,
+		"del":    h.del,
+		"exists": h.exists,
+		"incr":   h.incr,
+		"expire": h.expire,
+		"ttl":    h.ttl,
+		"keys":   h.keys,
+	}
+	return h
+}
+
+func (h *respHandler) Handle(msg []byte) []byte {
+	args, _, err := readRESPCommand(bufio.NewReader(bytes.NewReader(msg)), len(msg))
+	if err != nil {
+		return respError("ERR Protocol error: " + err.Error())
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := h.commands[name]
+	if !ok {
+		return respError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return cmd(args[1:])
+}
+
+func wrongArgs(name string) []byte {
+	return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+}
+
+func (h *respHandler) ping(args [][]byte) []byte {
+	switch len(args) {
+	case 0:
+		return respSimple("PONG")
+	case 1:
+		return respBulk(args[0])
+	default:
+		return wrongArgs("ping")
+	}
+}
+
+func (h *respHandler) get(args [][]byte) []byte {
+	if len(args) != 1 {
+		return wrongArgs("get")
+	}
+
+	value, ok := h.store.get(string(args[0]))
+	if !ok {
+		return respNull()
+	}
+	return respBulk(value)
+}
+
+// set supports SET key value [EX seconds | PX milliseconds].
+func (h *respHandler) set(args [][]byte) []byte {
+	if len(args) != 2 && len(args) != 4 {
+		if len(args) < 2 {
+			return wrongArgs("set")
+		}
+		return respError("ERR syntax error")
+	}
+
+	var ttl time.Duration
+	if len(args) == 4 {
+		n, err := strconv.ParseInt(string(args[3]), 10, 64)
+		if err != nil {
+			return respError("ERR " + errNotInteger.Error())
+		}
+		if n <= 0 {
+			return respError("ERR invalid expire time in 'set' command")
+		}
+
+		var unit time.Duration
+		switch {
+		case bytes.EqualFold(args[2], []byte("EX")):
+			unit = time.Second
+		case bytes.EqualFold(args[2], []byte("PX")):
+			unit = time.Millisecond
+		default:
+			return respError("ERR syntax error")
+		}
+		var ok bool
+		if ttl, ok = expireDuration(n, unit); !ok {
+			return respError("ERR invalid expire time in 'set' command")
+		}
+	}
+
+	h.store.set(string(args[0]), args[1], ttl)
+	return respSimple("OK")
+}
+
+func (h *respHandler) del(args [][]byte) []byte {
+	if len(args) == 0 {
+		return wrongArgs("del")
+	}
+	return respInt(int64(h.store.del(stringArgs(args)...)))
+}
+
+func (h *respHandler) exists(args [][]byte) []byte {
+	if len(args) == 0 {
+		return wrongArgs("exists")
+	}
+	return respInt(int64(h.store.exists(stringArgs(args)...)))
+}
+
+func (h *respHandler) incr(args [][]byte) []byte {
+	if len(args) != 1 {
+		return wrongArgs("incr")
+	}
+
+	n, err := h.store.incr(string(args[0]))
+	if err != nil {
+		return respError("ERR " + err.Error())
+	}
+	return respInt(n)
+}
+
+func (h *respHandler) expire(args [][]byte) []byte {
+	if len(args) != 2 {
+		return wrongArgs("expire")
+	}
+
+	seconds, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return respError("ERR " + errNotInteger.Error())
+	}
+
+	ttl, ok := expireDuration(seconds, time.Second)
+	if !ok {
+		return respError("ERR invalid expire time in 'expire' command")
+	}
+
+	if h.store.expire(string(args[0]), ttl) {
+		return respInt(1)
+	}
+	return respInt(0)
+}
+
+// expireDuration converts n units to a duration, reporting false when
+// the result does not fit rather than letting it wrap around.
+func expireDuration(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func (h *respHandler) ttl(args [][]byte) []byte {
+	if len(args) != 1 {
+		return wrongArgs("ttl")
+	}
+
+	ttl := h.store.ttl(string(args[0]))
+	if ttl < 0 {
+		return respInt(int64(ttl))
+	}
+	return respInt(int64((ttl + time.Second/2) / time.Second))
+}
+
+func (h *respHandler) keys(args [][]byte) []byte {
+	if len(args) != 1 {
+		return wrongArgs("keys")
+	}
+
+	keys := h.store.keys(string(args[0]))
+	items := make([][]byte, len(keys))
+	for i, key := range keys {
+		items[i] = []byte(key)
+	}
+	return respArray(items)
+}
+
+func stringArgs(args [][]byte) []string {
+	s := make([]string, len(args))
+	for i, arg := range args {
+		s[i] = string(arg)
+	}
+	return s
+}
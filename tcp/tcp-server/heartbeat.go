@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Heartbeat frames start with an ASCII DLE control byte so that a
+// message that merely reads PING or PONG still reaches the handler.
+var (
+	pingFrame = []byte("\x10PING")
+	pongFrame = []byte("\x10PONG")
+)
+
+// heartbeatOptions enables application-level dead-peer detection: the
+// server sends a PING frame after interval without receiving a frame
+// and drops the peer if nothing arrives within timeout after that.
+type heartbeatOptions struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func (o heartbeatOptions) enabled() bool {
+	return o.interval > 0
+}
+
+type keepAliveOptions struct {
+	disabled bool
+	idle     time.Duration
+	interval time.Duration
+	count    int
+}
+
+// listenConfig returns a ListenConfig applying the TCP keepalive
+// settings. Zero values keep the Go or OS defaults.
+func (o keepAliveOptions) listenConfig() net.ListenConfig {
+	if o.disabled {
+		return net.ListenConfig{KeepAlive: -1}
+	}
+
+	return net.ListenConfig{
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     o.idle,
+			Interval: o.interval,
+			Count:    o.count,
+		},
+	}
+}
+
+// frameWriter serializes writes so that heartbeat frames and responses
+// from the read loop do not interleave.
+type frameWriter struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	codec   frameCodec
+	timeout time.Duration
+}
+
+func (w *frameWriter) write(payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+		return err
+	}
+	return w.codec.WriteFrame(payload)
+}
+
+// heartbeat sends a PING whenever the connection has been idle for the
+// configured interval, until done is closed. lastRead holds the time of
+// the last received frame in Unix nanoseconds.
+func (s *server) heartbeat(w *frameWriter, lastRead *atomic.Int64, done <-chan struct{}, clientAddr string) {
+	interval := s.cfg.heartbeat.interval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, lastRead.Load()))
+		if idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+
+		if err := w.write(pingFrame); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error sending heartbeat to %s: %v\n", clientAddr, err)
+			return
+		}
+		timer.Reset(interval)
+	}
+}
+
+// isHeartbeat reports whether msg is a heartbeat control frame rather
+// than a message for the command handler.
+func isHeartbeat(msg []byte) bool {
+	return bytes.Equal(msg, pingFrame) || bytes.Equal(msg, pongFrame)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const expireSweepInterval = time.Second
+
+var errNotInteger = errors.New("value is not an integer or out of range")
+
+type kvEntry struct {
+	value    []byte
+	expireAt time.Time // zero when the key does not expire
+}
+
+func (e *kvEntry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// kvStore is an in-memory key/value store with per-key expiry. Expired
+// keys are hidden on access and removed by a background sweep.
+type kvStore struct {
+	mu   sync.Mutex
+	data map[string]*kvEntry
+}
+
+func newKVStore() *kvStore {
+	s := &kvStore{
+		data: make(map[string]*kvEntry),
+	}
+	go s.sweepLoop()
+	return s
+}
+
+func (s *kvStore) sweepLoop() {
+	ticker := time.NewTicker(expireSweepInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.mu.Lock()
+		for key, e := range s.data {
+			if e.expired(now) {
+				delete(s.data, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// lookup returns the live entry for key. The caller must hold s.mu.
+func (s *kvStore) lookup(key string, now time.Time) (*kvEntry, bool) {
+	e, ok := s.data[key]
+	if !ok {
+		return nil, false
+	}
+	if e.expired(now) {
+		delete(s.data, key)
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *kvStore) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookup(key, time.Now())
+	if !ok {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// set stores value under key. A ttl of zero means no expiry.
+func (s *kvStore) set(key string, value []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := &kvEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		e.expireAt = time.Now().Add(ttl)
+	}
+	s.data[key] = e
+}
+
+func (s *kvStore) del(keys ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, key := range keys {
+		if _, ok := s.lookup(key, now); ok {
+			delete(s.data, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *kvStore) exists(keys ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, key := range keys {
+		if _, ok := s.lookup(key, now); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// incr adds one to the integer stored at key, keeping its expiry.
+func (s *kvStore) incr(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookup(key, time.Now())
+	if !ok {
+		s.data[key] = &kvEntry{value: []byte("1")}
+		return 1, nil
+	}
+
+	n, err := strconv.ParseInt(string(e.value), 10, 64)
+	if err != nil || n == math.MaxInt64 {
+		return 0, errNotInteger
+	}
+	n++
+	e.value = strconv.AppendInt(nil, n, 10)
+	return n, nil
+}
+
+// expire sets a ttl on an existing key; a non-positive ttl deletes it.
+func (s *kvStore) expire(key string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e, ok := s.lookup(key, now)
+	if !ok {
+		return false
+	}
+	if ttl <= 0 {
+		delete(s.data, key)
+		return true
+	}
+	e.expireAt = now.Add(ttl)
+	return true
+}
+
+// ttl reports the remaining time to live, -1 if the key has no expiry
+// and -2 if it does not exist, matching the Redis TTL reply.
+func (s *kvStore) ttl(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e, ok := s.lookup(key, now)
+	switch {
+	case !ok:
+		return -2
+	case e.expireAt.IsZero():
+		return -1
+	default:
+		return e.expireAt.Sub(now)
+	}
+}
+
+func (s *kvStore) keys(pattern string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for key, e := range s.data {
+		if !e.expired(now) && globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// globMatch implements Redis glob-style patterns: *, ?, [abc], [^a-z]
+// and backslash escapes. Unlike path.Match, '*' also matches '/'.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			matched, rest, ok := matchClass(pattern[1:], s[0])
+			if !ok || !matched {
+				return false
+			}
+			pattern, s = rest, s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the character class at the start of
+// pattern (just after '['). It returns the pattern following ']'.
+func matchClass(pattern string, c byte) (matched bool, rest string, ok bool) {
+	negate := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		negate = true
+		pattern = pattern[1:]
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == ']':
+			return matched != negate, pattern[i+1:], true
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			if pattern[i] == c {
+				matched = true
+			}
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if lo <= c && c <= hi {
+				matched = true
+			}
+			i += 2
+		default:
+			if pattern[i] == c {
+				matched = true
+			}
+		}
+	}
+	return false, "", false
+}
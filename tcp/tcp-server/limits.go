@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errTooManyConns     = errors.New("global connection limit reached")
+	errTooManyConnsByIP = errors.New("per-IP connection limit reached")
+	errAcceptRateByIP   = errors.New("per-IP accept rate exceeded")
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+	bucketIdleTTL    = time.Minute
+)
+
+type limitOptions struct {
+	maxConns      int
+	maxConnsPerIP int
+	acceptRate    float64
+	acceptBurst   int
+}
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time, rate float64, burst int) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connLimiter enforces the global and per-IP connection limits.
+// A zero value in limitOptions disables the corresponding limit.
+type connLimiter struct {
+	opts      limitOptions
+	slots     chan struct{}
+	mu        sync.Mutex
+	active    map[string]int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newConnLimiter(opts limitOptions) *connLimiter {
+	l := &connLimiter{
+		opts:    opts,
+		active:  make(map[string]int),
+		buckets: make(map[string]*tokenBucket),
+	}
+	if opts.maxConns > 0 {
+		l.slots = make(chan struct{}, opts.maxConns)
+	}
+	return l
+}
+
+// acquireSlot reserves one of the global connection slots. It is
+// called in the accept loop, before a goroutine is started, so that
+// maxConns bounds the connections held open while their PROXY header
+// is read. The returned release function must be called once the
+// connection is closed.
+func (l *connLimiter) acquireSlot() (func(), error) {
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		return nil, errTooManyConns
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.slots })
+	}, nil
+}
+
+// acquire applies the per-IP limits to ip, which is only known once a
+// PROXY header has been read. The returned release function must be
+// called once the connection is closed.
+func (l *connLimiter) acquire(ip string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	if l.opts.acceptRate > 0 {
+		b, ok := l.buckets[ip]
+		if !ok {
+			b = &tokenBucket{tokens: float64(l.opts.acceptBurst), last: now}
+			l.buckets[ip] = b
+		}
+		if !b.allow(now, l.opts.acceptRate, l.opts.acceptBurst) {
+			return nil, errAcceptRateByIP
+		}
+	}
+
+	if l.opts.maxConnsPerIP > 0 && l.active[ip] >= l.opts.maxConnsPerIP {
+		return nil, errTooManyConnsByIP
+	}
+
+	l.active[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(ip) })
+	}, nil
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[ip]--; l.active[ip] <= 0 {
+		delete(l.active, ip)
+	}
+}
+
+// sweep drops token buckets that have been idle long enough to be full
+// again, so the map does not grow with every address ever seen.
+func (l *connLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketIdleTTL {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) >= bucketIdleTTL {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// nextAcceptBackoff doubles the delay after a failed Accept, so errors
+// such as EMFILE do not turn the accept loop into a busy loop.
+func nextAcceptBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptBackoff
+	}
+	delay *= 2
+	if delay > maxAcceptBackoff {
+		delay = maxAcceptBackoff
+	}
+	return delay
+}
@@ -1,115 +1,422 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+type config struct {
+	addr         string
+	framing      framingMode
+	handler      handlerKind
+	maxMsgSize   int
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	heartbeat    heartbeatOptions
+	keepAlive    keepAliveOptions
+	tls          tlsOptions
+	limits       limitOptions
+	drainTimeout time.Duration
+	metricsAddr  string
+	proxy        proxyOptions
+	unix         unixOptions
+}
+
 // go run .
 // go run . localhost:9090
+// go run . -framing length localhost:9090
+// go run . -handler resp localhost:6379
+// go run . -tls-dev
+// go run . -tls-cert server.pem -tls-key server-key.pem -tls-client-ca ca.pem
+// go run . -proxy-protocol -proxy-trusted 10.0.0.0/8
+// go run . -heartbeat-interval 10s -heartbeat-timeout 5s
+// go run . -unix-mode 0660 unix:///tmp/tcp-server.sock
+// go run . unix://@tcp-server
 func main() {
-	serverAddr := "localhost:8080"
-	if len(os.Args) > 1 {
-		serverAddr = os.Args[1]
+	cfg, err := parseFlags()
+	if err != nil {
+		log.Fatalf("Error parsing flags: %v\n", err)
 	}
 
-	err := serverRun(serverAddr)
+	err = serverRun(cfg)
 	if err != nil {
 		log.Fatalf("Error running server: %v\n", err)
 	}
 }
 
-func serverRun(serverAddr string) error {
-	listener, err := net.Listen("tcp", serverAddr)
+func parseFlags() (*config, error) {
+	framing := flag.String("framing", string(framingNewline), "message framing: newline, length (4-byte big-endian prefix), varint or resp")
+	handler := flag.String("handler", string(handlerEcho), "command handler: echo or resp (Redis-compatible key/value store)")
+	maxMsgSize := flag.Int("max-msg-size", 1024*1024, "maximum message size in bytes")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "per-message read timeout, replaced by the heartbeat window when heartbeats are enabled")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 0, "send a PING frame after this much idle time (0 disables heartbeats)")
+	heartbeatTimeout := flag.Duration("heartbeat-timeout", 10*time.Second, "drop the peer if nothing arrives this long after a PING")
+	keepAlive := flag.Bool("tcp-keepalive", true, "enable TCP keepalive probes")
+	keepAliveIdle := flag.Duration("tcp-keepalive-idle", 0, "idle time before the first keepalive probe (0 for the default)")
+	keepAliveInterval := flag.Duration("tcp-keepalive-interval", 0, "interval between keepalive probes (0 for the default)")
+	keepAliveCount := flag.Int("tcp-keepalive-count", 0, "unanswered probes before the connection is dropped (0 for the default)")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "per-message write timeout")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (PEM)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file (PEM)")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file (PEM) used to require and verify client certificates")
+	tlsDev := flag.Bool("tls-dev", false, "serve TLS with an in-memory self-signed certificate")
+	maxConns := flag.Int("max-conns", 1024, "maximum concurrent connections (0 for unlimited)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 32, "maximum concurrent connections per remote IP (0 for unlimited)")
+	acceptRate := flag.Float64("accept-rate", 10, "accepted connections per second per remote IP (0 for unlimited)")
+	acceptBurst := flag.Int("accept-burst", 20, "accept burst size per remote IP")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on this address, e.g. localhost:9100")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "expect a PROXY protocol v1/v2 header from trusted upstreams")
+	proxyTrusted := flag.String("proxy-trusted", "127.0.0.1,::1", "comma-separated IPs or CIDRs allowed to send a PROXY header")
+	unixMode := flag.String("unix-mode", "0660", "file mode of the Unix socket (octal)")
+	unixGroup := flag.String("unix-group", "", "group owning the Unix socket")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "time allowed for active connections to finish on shutdown")
+	flag.Parse()
+
+	mode, err := parseFramingMode(*framing)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, err := parseHandlerKind(*handler)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == handlerRESP {
+		if isFlagSet("framing") && mode != framingRESP {
+			return nil, fmt.Errorf("handler %s requires %s framing", kind, framingRESP)
+		}
+		mode = framingRESP
+	}
+
+	if *maxMsgSize <= 0 {
+		return nil, fmt.Errorf("invalid max message size: %d", *maxMsgSize)
+	}
+
+	if *heartbeatInterval > 0 {
+		if mode == framingRESP {
+			return nil, fmt.Errorf("heartbeats are not supported with %s framing", framingRESP)
+		}
+		if *heartbeatTimeout <= 0 {
+			return nil, fmt.Errorf("invalid heartbeat timeout: %v", *heartbeatTimeout)
+		}
+	}
+
+	socketMode, err := strconv.ParseUint(*unixMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unix socket mode: %s", *unixMode)
+	}
+
+	trusted, err := parseTrustedCIDRs(*proxyTrusted)
+	if err != nil {
+		return nil, err
+	}
+
+	if *acceptRate > 0 && *acceptBurst < 1 {
+		return nil, fmt.Errorf("invalid accept burst: %d", *acceptBurst)
+	}
+
+	cfg := &config{
+		addr:         "localhost:8080",
+		framing:      mode,
+		handler:      kind,
+		maxMsgSize:   *maxMsgSize,
+		readTimeout:  *readTimeout,
+		writeTimeout: *writeTimeout,
+		heartbeat: heartbeatOptions{
+			interval: *heartbeatInterval,
+			timeout:  *heartbeatTimeout,
+		},
+		keepAlive: keepAliveOptions{
+			disabled: !*keepAlive,
+			idle:     *keepAliveIdle,
+			interval: *keepAliveInterval,
+			count:    *keepAliveCount,
+		},
+		tls: tlsOptions{
+			certFile:     *tlsCert,
+			keyFile:      *tlsKey,
+			clientCAFile: *tlsClientCA,
+			dev:          *tlsDev,
+		},
+		limits: limitOptions{
+			maxConns:      *maxConns,
+			maxConnsPerIP: *maxConnsPerIP,
+			acceptRate:    *acceptRate,
+			acceptBurst:   *acceptBurst,
+		},
+		drainTimeout: *drainTimeout,
+		metricsAddr:  *metricsAddr,
+		proxy: proxyOptions{
+			enabled: *proxyProtocol,
+			trusted: trusted,
+		},
+		unix: unixOptions{
+			mode:  os.FileMode(socketMode),
+			group: *unixGroup,
+		},
+	}
+	if flag.NArg() > 0 {
+		cfg.addr = flag.Arg(0)
+	}
+
+	return cfg, nil
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func serverRun(cfg *config) error {
+	tlsConfig, err := newTLSConfig(cfg.tls)
+	if err != nil {
+		return fmt.Errorf("error configuring TLS: %w", err)
+	}
+
+	network, address := parseListenAddr(cfg.addr)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return fmt.Errorf("error preparing socket: %w", err)
+		}
+	}
+
+	lc := cfg.keepAlive.listenConfig()
+	listener, err := lc.Listen(context.Background(), network, address)
 	if err != nil {
 		return fmt.Errorf("error listening: %w", err)
 	}
-	defer listener.Close()
 
-	log.Printf("Server is listening on %s\n", serverAddr)
+	if network == "unix" {
+		if err := applySocketPermissions(address, cfg.unix); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	m := newMetrics()
+	listener = &countingListener{Listener: listener, metrics: m}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Error accepting a connection request: %v\n", err)
-			continue
+	srv := newServer(cfg, listener, tlsConfig, m)
+
+	errChan := make(chan error, 2)
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		log.Printf("Server is listening on %s (handler: %s, framing: %s, tls: %t)\n", cfg.addr, cfg.handler, cfg.framing, tlsConfig != nil)
+		if err := srv.serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errChan <- fmt.Errorf("error serving: %w", err)
 		}
+	}()
+
+	var metricsServer *http.Server
+	if cfg.metricsAddr != "" {
+		metricsServer = newMetricsServer(cfg.metricsAddr, m)
+		go func() {
+			log.Printf("Metrics are served on http://%s/metrics\n", cfg.metricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("error serving metrics: %w", err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-errChan:
+		listener.Close()
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
+		return err
+	case sig := <-shutdown:
+		return gracefulShutdown(srv, metricsServer, cfg, sig)
+	}
+}
+
+func newMetricsServer(addr string, m *metrics) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	return &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+func gracefulShutdown(srv *server, metricsServer *http.Server, cfg *config, sig os.Signal) error {
+	log.Printf("Received signal %v, draining connections for up to %v...\n", sig, cfg.drainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.drainTimeout)
+	defer cancel()
+
+	forced, err := srv.shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("error closing listener: %w", err)
+	}
+
+	if forced > 0 {
+		log.Printf("Drain timeout exceeded, force-closed %d connections\n", forced)
+	}
 
-		go handleClient(conn)
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			metricsServer.Close()
+		}
 	}
+
+	log.Println("Server shutdown completed")
+	return nil
 }
 
-func handleClient(conn net.Conn) {
+// handleClient serves conn, which may wrap the accepted socket raw in
+// PROXY protocol and TLS layers. Deadlines and shutdown tracking are
+// applied to raw.
+func (s *server) handleClient(raw, conn net.Conn) {
 	defer func() {
-		if err := conn.Close(); err != nil {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			log.Printf("Error closing connection: %v\n", err)
 		}
 	}()
 
 	clientAddr := conn.RemoteAddr().String()
+	if uc, ok := unixConn(raw); ok {
+		clientAddr = describeUnixPeer(uc)
+	} else if upstream := raw.RemoteAddr().String(); upstream != clientAddr {
+		clientAddr = fmt.Sprintf("%s via %s", clientAddr, upstream)
+	}
+
+	if err := s.beginRead(raw); err != nil {
+		return
+	}
+	if err := raw.SetWriteDeadline(time.Now().Add(s.cfg.writeTimeout)); err != nil {
+		log.Printf("Error setting write deadline for %s: %v\n", clientAddr, err)
+		return
+	}
+
+	subject, err := tlsHandshake(conn)
+	if err != nil {
+		log.Printf("Error establishing TLS with %s: %v\n", clientAddr, err)
+		return
+	}
+	if subject != "" {
+		clientAddr = fmt.Sprintf("%s [%s]", clientAddr, subject)
+	}
+
 	log.Printf("Accepted connection from %s\n", clientAddr)
 
-	const (
-		readTimeout  = 30 * time.Second
-		writeTimeout = 10 * time.Second
-		maxMsgSize   = 1024 * 1024
-	)
+	codec := newFrameCodec(s.cfg.framing, conn, s.cfg.maxMsgSize)
+	writer := &frameWriter{conn: conn, codec: codec, timeout: s.cfg.writeTimeout}
 
-	reader := bufio.NewReader(conn)
+	var lastRead atomic.Int64
+	lastRead.Store(time.Now().UnixNano())
+
+	if s.cfg.heartbeat.enabled() {
+		done := make(chan struct{})
+		defer close(done)
+		go s.heartbeat(writer, &lastRead, done, clientAddr)
+	}
 
 	for {
-		if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		if err := s.beginRead(raw); err != nil {
+			if errors.Is(err, errServerClosing) {
+				log.Printf("Closing connection from %s for shutdown\n", clientAddr)
+				return
+			}
 			log.Printf("Error setting read deadline for %s: %v\n", clientAddr, err)
 			return
 		}
 
-		msg, err := reader.ReadString('\n')
+		msg, err := codec.ReadFrame()
 		if err != nil {
-			handleReadError(err, clientAddr)
+			if s.isClosing() {
+				log.Printf("Closing connection from %s for shutdown\n", clientAddr)
+				return
+			}
+			s.metrics.readError(handleReadError(err, clientAddr))
 			return
 		}
+		lastRead.Store(time.Now().UnixNano())
 
-		if len(msg) > maxMsgSize {
-			log.Printf("Message too big from %s\n", clientAddr)
-			return
+		if s.cfg.heartbeat.enabled() && isHeartbeat(msg) {
+			if bytes.Equal(msg, pingFrame) {
+				if err := writer.write(pongFrame); err != nil {
+					log.Printf("Error writing to %s: %v\n", clientAddr, err)
+					return
+				}
+			}
+			continue
 		}
 
-		response := processMessage(msg)
+		s.endRead(raw)
+		s.metrics.messageReceived(len(msg))
 
-		if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
-			log.Printf("Error setting write deadline for %s: %v\n", clientAddr, err)
-			return
+		response := s.handler.Handle(msg)
+		if len(response) == 0 {
+			continue
 		}
 
-		_, err = conn.Write([]byte(response))
-		if err != nil {
+		if err := writer.write(response); err != nil {
 			log.Printf("Error writing to %s: %v\n", clientAddr, err)
 			return
 		}
+		s.metrics.messagesOut.Add(1)
 	}
 }
 
-func handleReadError(err error, clientAddr string) error {
+type readErrorKind string
+
+const (
+	readErrEOF           readErrorKind = "eof"
+	readErrUnexpectedEOF readErrorKind = "unexpected_eof"
+	readErrTimeout       readErrorKind = "timeout"
+	readErrTooLarge      readErrorKind = "too_large"
+	readErrProtocol      readErrorKind = "protocol"
+	readErrOther         readErrorKind = "other"
+)
+
+func handleReadError(err error, clientAddr string) readErrorKind {
 	switch {
 	case errors.Is(err, io.EOF):
 		log.Printf("Client %s disconnected normally\n", clientAddr)
-		return err
+		return readErrEOF
 	case errors.Is(err, io.ErrUnexpectedEOF):
-		return fmt.Errorf("unexpected EOF from %s", clientAddr)
+		log.Printf("Unexpected EOF from %s\n", clientAddr)
+		return readErrUnexpectedEOF
+	case errors.Is(err, errFrameTooLarge):
+		log.Printf("Message too big from %s\n", clientAddr)
+		return readErrTooLarge
+	case errors.Is(err, errRESPProtocol):
+		log.Printf("Protocol error from %s: %v\n", clientAddr, err)
+		return readErrProtocol
 	default:
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return fmt.Errorf("connection timeout from %s", clientAddr)
+			log.Printf("Connection timeout from %s\n", clientAddr)
+			return readErrTimeout
 		}
-		return fmt.Errorf("error reading from %s: %v", clientAddr, err)
+		log.Printf("Error reading from %s: %v\n", clientAddr, err)
+		return readErrOther
 	}
 }
 
 func processMessage(msg string) string {
-	return fmt.Sprintf("Message received: %s\n", msg)
+	return fmt.Sprintf("Message received: %s", msg)
 }
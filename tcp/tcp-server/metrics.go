@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// messageSizeBuckets are the upper bounds, in bytes, of the message size
+// histogram buckets.
+var messageSizeBuckets = []int{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// metrics holds the server counters and gauges, exported in the
+// Prometheus text exposition format.
+type metrics struct {
+	activeConns   atomic.Int64
+	acceptedConns atomic.Uint64
+	bytesIn       atomic.Uint64
+	bytesOut      atomic.Uint64
+	messagesIn    atomic.Uint64
+	messagesOut   atomic.Uint64
+
+	sizeBuckets []atomic.Uint64
+	sizeSum     atomic.Uint64
+	sizeCount   atomic.Uint64
+
+	mu         sync.Mutex
+	rejected   map[string]uint64
+	readErrors map[readErrorKind]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		sizeBuckets: make([]atomic.Uint64, len(messageSizeBuckets)),
+		rejected:    make(map[string]uint64),
+		readErrors:  make(map[readErrorKind]uint64),
+	}
+}
+
+func (m *metrics) connRejected(err error) {
+	reason := "other"
+	switch {
+	case errors.Is(err, errTooManyConns):
+		reason = "max_conns"
+	case errors.Is(err, errTooManyConnsByIP):
+		reason = "max_conns_per_ip"
+	case errors.Is(err, errAcceptRateByIP):
+		reason = "accept_rate"
+	case errors.Is(err, errProxyHeader):
+		reason = "proxy_header"
+	}
+
+	m.mu.Lock()
+	m.rejected[reason]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) readError(kind readErrorKind) {
+	m.mu.Lock()
+	m.readErrors[kind]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) messageReceived(size int) {
+	m.messagesIn.Add(1)
+	m.sizeSum.Add(uint64(size))
+	m.sizeCount.Add(1)
+
+	// Buckets are stored non-cumulatively and summed on export.
+	for i, bound := range messageSizeBuckets {
+		if size <= bound {
+			m.sizeBuckets[i].Add(1)
+			break
+		}
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	writeMetric(w, "tcp_server_connections_active", "gauge", "Number of open client connections.", m.activeConns.Load())
+	writeMetric(w, "tcp_server_connections_accepted_total", "counter", "Connections accepted.", m.acceptedConns.Load())
+	writeMetric(w, "tcp_server_bytes_received_total", "counter", "Bytes read from clients.", m.bytesIn.Load())
+	writeMetric(w, "tcp_server_bytes_sent_total", "counter", "Bytes written to clients.", m.bytesOut.Load())
+	writeMetric(w, "tcp_server_messages_received_total", "counter", "Messages read from clients.", m.messagesIn.Load())
+	writeMetric(w, "tcp_server_messages_sent_total", "counter", "Responses written to clients.", m.messagesOut.Load())
+
+	m.mu.Lock()
+	rejected := make(map[string]uint64, len(m.rejected))
+	for reason, n := range m.rejected {
+		rejected[reason] = n
+	}
+	readErrors := make(map[string]uint64, len(m.readErrors))
+	for kind, n := range m.readErrors {
+		readErrors[string(kind)] = n
+	}
+	m.mu.Unlock()
+
+	writeLabeledMetric(w, "tcp_server_connections_rejected_total", "Connections rejected before being served.", "reason", rejected)
+	writeLabeledMetric(w, "tcp_server_read_errors_total", "Connections ended by a read error, by category.", "category", readErrors)
+
+	const name = "tcp_server_message_size_bytes"
+	fmt.Fprintf(w, "# HELP %s Size of received messages.\n# TYPE %s histogram\n", name, name)
+	var cumulative uint64
+	for i, bound := range messageSizeBuckets {
+		cumulative += m.sizeBuckets[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%d\"} %d\n", name, bound, cumulative)
+	}
+	count := m.sizeCount.Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %d\n", name, m.sizeSum.Load())
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+func writeMetric[T int64 | uint64](w io.Writer, name, typ, help string, value T) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, value)
+}
+
+func writeLabeledMetric(w io.Writer, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, label, strconv.Quote(k), values[k])
+	}
+}
+
+// countingListener wraps accepted connections so that bytes on the wire
+// are counted, including TLS overhead.
+type countingListener struct {
+	net.Listener
+	metrics *metrics
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, metrics: l.metrics}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	metrics *metrics
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.metrics.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.metrics.bytesOut.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// readPeerCred returns the credentials of the process on the other end
+// of a Unix socket, as captured by the kernel at connect time.
+func readPeerCred(conn *net.UnixConn) (peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCred{}, err
+	}
+	if credErr != nil {
+		return peerCred{}, credErr
+	}
+
+	return peerCred{uid: ucred.Uid, gid: ucred.Gid, pid: ucred.Pid}, nil
+}
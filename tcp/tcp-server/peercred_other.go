@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func readPeerCred(conn *net.UnixConn) (peerCred, error) {
+	return peerCred{}, errors.New("peer credentials are only supported on Linux")
+}
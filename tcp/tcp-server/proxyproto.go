@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// HAProxy PROXY protocol, see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+const (
+	proxyV1MaxLen    = 107
+	proxyV2HeaderLen = 16
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+type proxyOptions struct {
+	enabled bool
+	trusted []*net.IPNet
+}
+
+func parseTrustedCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if !strings.Contains(field, "/") {
+			if ip := net.ParseIP(field); ip != nil && ip.To4() != nil {
+				field += "/32"
+			} else {
+				field += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted upstream %q: %w", field, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// trusts reports whether a PROXY header is expected from addr.
+func (o proxyOptions) trusts(addr net.Addr) bool {
+	if !o.enabled {
+		return false
+	}
+
+	ip := net.ParseIP(remoteIP(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range o.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn reports the client addresses carried by the PROXY header
+// instead of those of the upstream socket.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY header from conn. LOCAL and
+// UNKNOWN headers, used by health checks, keep the socket addresses.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	pc := &proxyConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+
+	sig, err := pc.r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV1Prefix) {
+		err = pc.readV1()
+	} else {
+		err = pc.readV2()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (pc *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := pc.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("%w: v1 header not terminated by CRLF", errProxyHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("%w: %q", errProxyHeader, line)
+	}
+
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	pc.remote, pc.local = src, dst
+	return nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: bad address %q", errProxyHeader, host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad port %q", errProxyHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func (pc *proxyConn) readV2() error {
+	var hdr [proxyV2HeaderLen]byte
+	if _, err := io.ReadFull(pc.r, hdr[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return fmt.Errorf("%w: missing signature", errProxyHeader)
+	}
+
+	verCmd, family := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return fmt.Errorf("%w: unsupported version %d", errProxyHeader, verCmd>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(pc.r, payload); err != nil {
+		return err
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL
+		return nil
+	case 0x1: // PROXY
+	default:
+		return fmt.Errorf("%w: unsupported command %d", errProxyHeader, verCmd&0x0f)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return fmt.Errorf("%w: short IPv4 address block", errProxyHeader)
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		pc.local = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return fmt.Errorf("%w: short IPv6 address block", errProxyHeader)
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		pc.local = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	}
+	// Other families are accepted but keep the socket addresses, as the
+	// specification requires. TLVs following the addresses are ignored.
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxRESPArgs bounds the element count of a request array so a tiny
+// header cannot make the server allocate a huge slice.
+const maxRESPArgs = 1024 * 1024
+
+var errRESPProtocol = errors.New("resp protocol error")
+
+// respCodec frames RESP2 requests: arrays of bulk strings as sent by
+// redis-cli and client libraries, or inline commands typed by hand.
+// ReadFrame returns the raw bytes of one complete request.
+type respCodec struct {
+	r       *bufio.Reader
+	w       io.Writer
+	maxSize int
+}
+
+func (c *respCodec) ReadFrame() ([]byte, error) {
+	_, raw, err := readRESPCommand(c.r, c.maxSize)
+	return raw, err
+}
+
+// WriteFrame writes payload as is; RESP replies are self-delimiting.
+func (c *respCodec) WriteFrame(payload []byte) error {
+	_, err := c.w.Write(payload)
+	return err
+}
+
+// readRESPCommand reads one request and returns its arguments along with
+// the raw bytes consumed. No more than maxSize bytes are buffered.
+func readRESPCommand(r *bufio.Reader, maxSize int) ([][]byte, []byte, error) {
+	rr := &respReader{r: r, remaining: maxSize}
+
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if first[0] != '*' {
+		line, err := rr.readLine()
+		if err != nil {
+			return nil, nil, err
+		}
+		return bytes.Fields(line), rr.raw, nil
+	}
+
+	line, err := rr.readLine()
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxRESPArgs {
+		return nil, nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+
+	args := make([][]byte, 0, min(n, 64))
+	for i := 0; i < n; i++ {
+		arg, err := rr.readBulk()
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, rr.raw, nil
+}
+
+// respReader tracks the bytes consumed for a single request and fails
+// with errFrameTooLarge as soon as they would exceed the budget.
+type respReader struct {
+	r         *bufio.Reader
+	raw       []byte
+	remaining int
+}
+
+func (rr *respReader) consume(p []byte) error {
+	if len(p) > rr.remaining {
+		return errFrameTooLarge
+	}
+	rr.remaining -= len(p)
+	rr.raw = append(rr.raw, p...)
+	return nil
+}
+
+// readLine returns the next line without its CRLF or LF terminator.
+func (rr *respReader) readLine() ([]byte, error) {
+	start := len(rr.raw)
+	for {
+		chunk, err := rr.r.ReadSlice('\n')
+		if cerr := rr.consume(chunk); cerr != nil {
+			return nil, cerr
+		}
+
+		switch {
+		case err == nil:
+			line := bytes.TrimSuffix(rr.raw[start:], []byte("\n"))
+			return bytes.TrimSuffix(line, []byte("\r")), nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(rr.raw) > 0:
+			return nil, io.ErrUnexpectedEOF
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (rr *respReader) readBulk() ([]byte, error) {
+	line, err := rr.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, fmt.Errorf("%w: expected '$', got %q", errRESPProtocol, line)
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+	}
+	// Compare without adding, which could overflow for lengths near
+	// the int limit.
+	if n > rr.remaining-2 {
+		return nil, errFrameTooLarge
+	}
+
+	start := len(rr.raw)
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if !bytes.HasSuffix(buf, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errRESPProtocol)
+	}
+	if err := rr.consume(buf); err != nil {
+		return nil, err
+	}
+
+	return rr.raw[start : start+n], nil
+}
+
+func respSimple(s string) []byte {
+	return []byte("+" + s + "\r\n")
+}
+
+func respError(s string) []byte {
+	return []byte("-" + s + "\r\n")
+}
+
+func respInt(n int64) []byte {
+	return []byte(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func respNull() []byte {
+	return []byte("$-1\r\n")
+}
+
+func respBulk(b []byte) []byte {
+	buf := make([]byte, 0, len(b)+16)
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(b)), 10)
+	buf = append(buf, "\r\n"...)
+	buf = append(buf, b...)
+	return append(buf, "\r\n"...)
+}
+
+func respArray(items [][]byte) []byte {
+	buf := []byte("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		buf = append(buf, respBulk(item)...)
+	}
+	return buf
+}
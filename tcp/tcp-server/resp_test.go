@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadRESPCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		maxSize int
+		want    []string
+		err     error
+	}{
+		{name: "array", input: "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", maxSize: 64, want: []string{"GET", "key"}},
+		{name: "inline", input: "SET key value\r\n", maxSize: 64, want: []string{"SET", "key", "value"}},
+		{name: "empty bulk", input: "*1\r\n$0\r\n\r\n", maxSize: 64, want: []string{""}},
+		{name: "bulk over budget", input: "*1\r\n$100\r\n", maxSize: 64, err: errFrameTooLarge},
+		{name: "bulk length near max int", input: "*1\r\n$9223372036854775807\r\n", maxSize: 64, err: errFrameTooLarge},
+		{name: "bulk length past max int", input: "*1\r\n$9223372036854775808\r\n", maxSize: 64, err: errRESPProtocol},
+		{name: "negative bulk length", input: "*1\r\n$-1\r\n", maxSize: 64, err: errRESPProtocol},
+		{name: "too many args", input: "*9999999\r\n", maxSize: 64, err: errRESPProtocol},
+		{name: "missing CRLF", input: "*1\r\n$3\r\nGETX\r\n", maxSize: 64, err: errRESPProtocol},
+		{name: "line over budget", input: strings.Repeat("a", 100) + "\r\n", maxSize: 64, err: errFrameTooLarge},
+		{name: "truncated", input: "*2\r\n$3\r\nGET\r\n", maxSize: 64, err: io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, raw, err := readRESPCommand(bufio.NewReader(strings.NewReader(tt.input)), tt.maxSize)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(args) != len(tt.want) {
+				t.Fatalf("got %d args, want %d", len(args), len(tt.want))
+			}
+			for i := range args {
+				if string(args[i]) != tt.want[i] {
+					t.Errorf("arg %d = %q, want %q", i, args[i], tt.want[i])
+				}
+			}
+			if string(raw) != tt.input {
+				t.Errorf("raw = %q, want %q", raw, tt.input)
+			}
+		})
+	}
+}
+
+func FuzzReadRESPCommand(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"))
+	f.Add([]byte("PING\r\n"))
+	f.Add([]byte("*1\r\n$9223372036854775807\r\n"))
+	f.Add([]byte("*1\r\n$-1\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		const maxSize = 256
+		_, raw, err := readRESPCommand(bufio.NewReader(bytes.NewReader(data)), maxSize)
+		if err == nil && len(raw) > maxSize {
+			t.Fatalf("consumed %d bytes, over the %d byte budget", len(raw), maxSize)
+		}
+	})
+}
+
+func TestRESPHandlerRejectsHugeTTL(t *testing.T) {
+	h := newRESPHandler(newKVStore())
+	h.Handle([]byte("SET key value\r\n"))
+
+	for _, cmd := range []string{
+		"SET key value EX 9223372036854775807\r\n",
+		"SET key value PX 9223372036854775807\r\n",
+		"EXPIRE key 9223372036854775807\r\n",
+	} {
+		if got := string(h.Handle([]byte(cmd))); !strings.HasPrefix(got, "-ERR invalid expire time") {
+			t.Errorf("%q: got %q, want an invalid expire time error", cmd, got)
+		}
+	}
+	if got := string(h.Handle([]byte("GET key\r\n"))); got != "$5\r\nvalue\r\n" {
+		t.Errorf("key was changed by a rejected TTL: GET returned %q", got)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var errServerClosing = errors.New("server is shutting down")
+
+type server struct {
+	cfg       *config
+	listener  net.Listener
+	tlsConfig *tls.Config
+	limiter   *connLimiter
+	handler   commandHandler
+	metrics   *metrics
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	conns   map[net.Conn]bool // keyed by the accepted socket; true while a message is being processed
+	closing bool
+}
+
+func newServer(cfg *config, listener net.Listener, tlsConfig *tls.Config, m *metrics) *server {
+	return &server{
+		cfg:       cfg,
+		listener:  listener,
+		tlsConfig: tlsConfig,
+		limiter:   newConnLimiter(cfg.limits),
+		handler:   newCommandHandler(cfg.handler),
+		metrics:   m,
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// serve runs the accept loop until the listener is closed.
+func (s *server) serve() error {
+	var backoff time.Duration
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			backoff = nextAcceptBackoff(backoff)
+			log.Printf("Error accepting a connection request: %v; retrying in %v\n", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		releaseSlot, err := s.limiter.acquireSlot()
+		if err != nil {
+			log.Printf("Rejected connection from %s: %v\n", conn.RemoteAddr(), err)
+			s.metrics.connRejected(err)
+			conn.Close()
+			continue
+		}
+
+		if !s.trackConn(conn) {
+			releaseSlot()
+			conn.Close()
+			return net.ErrClosed
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer releaseSlot()
+			defer s.untrackConn(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn resolves the client address from a PROXY header when the
+// peer is a trusted upstream, applies the per-IP limits to that address
+// and then hands the connection, wrapped in TLS if enabled, to
+// handleClient. Only connections admitted here count as active.
+func (s *server) serveConn(raw net.Conn) {
+	conn := raw
+
+	if s.cfg.proxy.trusts(raw.RemoteAddr()) {
+		if err := s.beginRead(raw); err != nil {
+			raw.Close()
+			return
+		}
+
+		pc, err := readProxyHeader(raw)
+		if err != nil {
+			if !s.isClosing() {
+				log.Printf("Rejected connection from %s: %v\n", raw.RemoteAddr(), err)
+				s.metrics.connRejected(err)
+			}
+			raw.Close()
+			return
+		}
+		conn = pc
+	}
+
+	release, err := s.limiter.acquire(clientKey(conn))
+	if err != nil {
+		log.Printf("Rejected connection from %s: %v\n", conn.RemoteAddr(), err)
+		s.metrics.connRejected(err)
+		raw.Close()
+		return
+	}
+	defer release()
+	s.metrics.acceptedConns.Add(1)
+	s.metrics.activeConns.Add(1)
+	defer s.metrics.activeConns.Add(-1)
+
+	if s.tlsConfig != nil {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+
+	s.handleClient(raw, conn)
+}
+
+func (s *server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = false
+	return true
+}
+
+func (s *server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// readWindow is how long a connection may go without a complete frame.
+func (s *server) readWindow() time.Duration {
+	if s.cfg.heartbeat.enabled() {
+		return s.cfg.heartbeat.interval + s.cfg.heartbeat.timeout
+	}
+	return s.cfg.readTimeout
+}
+
+// beginRead marks conn as idle and arms its read deadline. Once shutdown
+// has started it returns errServerClosing so the handler stops before
+// waiting for another message.
+func (s *server) beginRead(conn net.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return errServerClosing
+	}
+	s.conns[conn] = false
+	return conn.SetReadDeadline(time.Now().Add(s.readWindow()))
+}
+
+// endRead marks conn as busy until its response has been written.
+func (s *server) endRead(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns[conn] = true
+}
+
+func (s *server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closing
+}
+
+// shutdown stops accepting, interrupts idle connections and waits for
+// busy ones to finish their current message. Connections still open
+// when ctx expires are closed forcibly; their count is returned.
+func (s *server) shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.closing = true
+	err := s.listener.Close()
+	for conn, busy := range s.conns {
+		if !busy {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0, err
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	forced := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	<-done
+	return forced, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+type tlsOptions struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	dev          bool
+}
+
+func (o tlsOptions) enabled() bool {
+	return o.dev || o.certFile != "" || o.keyFile != ""
+}
+
+// newTLSConfig returns nil when TLS is not enabled.
+func newTLSConfig(opts tlsOptions) (*tls.Config, error) {
+	if !opts.enabled() {
+		if opts.clientCAFile != "" {
+			return nil, fmt.Errorf("client CA requires a certificate or dev mode")
+		}
+		return nil, nil
+	}
+
+	var cert tls.Certificate
+	switch {
+	case opts.dev:
+		if opts.certFile != "" || opts.keyFile != "" {
+			return nil, fmt.Errorf("dev mode cannot be combined with a certificate file")
+		}
+
+		c, err := generateSelfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate self-signed certificate: %w", err)
+		}
+		cert = c
+
+		fingerprint := sha256.Sum256(cert.Certificate[0])
+		log.Printf("Using self-signed dev certificate (SHA-256 %s)\n", hex.EncodeToString(fingerprint[:]))
+	default:
+		c, err := tls.LoadX509KeyPair(opts.certFile, opts.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load key pair: %w", err)
+		}
+		cert = c
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if opts.clientCAFile != "" {
+		pool, err := loadCertPool(opts.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// generateSelfSignedCert creates an in-memory certificate valid for
+// localhost, intended for local development only.
+func generateSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "tcp-server dev"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// tlsHandshake completes the handshake on TLS connections and returns
+// the verified client certificate subject, if any. The caller is
+// responsible for setting deadlines.
+func tlsHandshake(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", fmt.Errorf("tls handshake: %w", err)
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+	return state.PeerCertificates[0].Subject.String(), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const unixScheme = "unix://"
+
+type unixOptions struct {
+	mode  os.FileMode
+	group string
+}
+
+// parseListenAddr splits addr into a network and address for net.Listen.
+// unix:///path/to.sock selects a Unix domain socket and unix://@name a
+// Linux abstract socket; anything else is a TCP host:port.
+func parseListenAddr(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+func isAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run.
+// A socket that still accepts connections is left alone.
+func removeStaleSocket(path string) error {
+	if isAbstractSocket(path) {
+		return nil
+	}
+
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("could not probe %s: %w", path, err)
+	}
+
+	log.Printf("Removing stale socket %s\n", path)
+	return os.Remove(path)
+}
+
+// applySocketPermissions sets the mode and group of a socket file.
+func applySocketPermissions(path string, opts unixOptions) error {
+	if isAbstractSocket(path) {
+		return nil
+	}
+
+	if err := os.Chmod(path, opts.mode); err != nil {
+		return fmt.Errorf("could not chmod socket: %w", err)
+	}
+
+	if opts.group == "" {
+		return nil
+	}
+
+	g, err := user.LookupGroup(opts.group)
+	if err != nil {
+		g, err = user.LookupGroupId(opts.group)
+		if err != nil {
+			return fmt.Errorf("unknown group %s", opts.group)
+		}
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %s: %w", g.Gid, err)
+	}
+
+	if err := os.Chown(path, -1, gid); err != nil {
+		return fmt.Errorf("could not chown socket: %w", err)
+	}
+	return nil
+}
+
+type peerCred struct {
+	uid uint32
+	gid uint32
+	pid int32
+}
+
+func (c peerCred) String() string {
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", c.uid, c.gid, c.pid)
+}
+
+// unixConn returns the Unix socket underneath conn, if there is one.
+func unixConn(conn net.Conn) (*net.UnixConn, bool) {
+	if cc, ok := conn.(*countingConn); ok {
+		conn = cc.Conn
+	}
+	uc, ok := conn.(*net.UnixConn)
+	return uc, ok
+}
+
+// clientKey is the identity used for per-client connection limits: the
+// remote IP for TCP, the peer uid for Unix sockets.
+func clientKey(conn net.Conn) string {
+	uc, ok := unixConn(conn)
+	if !ok {
+		return remoteIP(conn.RemoteAddr())
+	}
+
+	if cred, err := readPeerCred(uc); err == nil {
+		return "uid:" + strconv.FormatUint(uint64(cred.uid), 10)
+	}
+	return "unix"
+}
+
+// describeUnixPeer labels a Unix socket client for the logs, since its
+// remote address is usually empty.
+func describeUnixPeer(conn *net.UnixConn) string {
+	label := "unix"
+	if addr := conn.RemoteAddr(); addr != nil && addr.String() != "" && addr.String() != "@" {
+		label += ":" + addr.String()
+	}
+
+	cred, err := readPeerCred(conn)
+	if err != nil {
+		return label
+	}
+	return fmt.Sprintf("%s (%s)", label, cred)
+}